@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/janelia-flyem/raveler-exporter/exporter"
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// command is a subcommand given as the first argument after any options.
+type command struct {
+	nargs int    // number of required arguments
+	usage string // argument description for errors
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"index-map":   {1, "index-map <superpixel-to-segment-map>", indexMap},
+	"compile-map": {3, "compile-map <superpixel-to-segment-map> <segment-to-body-map> <output file>", compileMap},
+	"validate":    {2, "validate <superpixel-to-segment-map> <segment-to-body-map>", validateMaps},
+	"audit-dvid":  {2, "audit-dvid <DVID data URL> <slab directory>", auditDVID},
+	"inspect":     {1, "inspect <slab file or compiled map>", inspectSlab},
+	"verify":      {4, "verify <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory> <slab directory>", verifySlabs},
+	"plan":        {3, "plan <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory>", planExport},
+	"check-images": {4, "check-images <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory> <report file>",
+		checkImages},
+}
+
+// runCommand runs a subcommand after checking its number of arguments.
+func runCommand(cmd command, args []string) error {
+	if len(args) != cmd.nargs {
+		return fmt.Errorf("usage: raveler-exporter [options] %s", cmd.usage)
+	}
+	return cmd.run(args)
+}
+
+func indexMap(args []string) error {
+	return exporter.BuildSliceIndex(args[0])
+}
+
+func compileMap(args []string) error {
+	table, err := exporter.LoadBodyTable(args[0], args[1], *minz, *maxz)
+	if err != nil {
+		return err
+	}
+	if err := exporter.WriteCompiledMap(table, args[2]); err != nil {
+		return err
+	}
+	return exporter.VerifyCompiledMap(args[2])
+}
+
+func validateMaps(args []string) error {
+	v, err := exporter.ValidateMaps(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	v.Report(os.Stdout)
+	if !v.OK() {
+		return fmt.Errorf("problems found in Raveler maps")
+	}
+	return nil
+}
+
+func checkImages(args []string) error {
+	opts := exportOptions()
+	opts.SuperpixelToSegment = args[0]
+	opts.SegmentToBody = args[1]
+	sp2body, err := opts.BodyTable()
+	if err != nil {
+		return err
+	}
+	defer sp2body.Close()
+
+	c, err := exporter.CheckImages(exporter.NewPNGDirSource(args[2]), sp2body, opts.MinZ, opts.MaxZ)
+	if err != nil {
+		return err
+	}
+	if err := c.WriteJSON(args[3]); err != nil {
+		return err
+	}
+	fmt.Printf("Checked %s\nWrote report to %s\n", c.Summary(), args[3])
+	if !c.OK() {
+		return fmt.Errorf("superpixel images don't match the mapping")
+	}
+	return nil
+}
+
+func planExport(args []string) error {
+	opts := exportOptions()
+	opts.SuperpixelToSegment = args[0]
+	opts.SegmentToBody = args[1]
+	opts.SuperpixelDir = args[2]
+	p, err := exporter.MakePlan(opts, *filesPerJob)
+	if err != nil {
+		return err
+	}
+	p.Report(os.Stdout)
+	return nil
+}
+
+func inspectSlab(args []string) error {
+	if exporter.IsCompiledMap(args[0]) {
+		return inspectCompiledMap(args[0])
+	}
+	sf, err := slabs.Read(args[0])
+	if err != nil {
+		return err
+	}
+	md := sf.Metadata
+	source := "file name"
+	if sf.HasSidecar {
+		source = "sidecar"
+	}
+	fmt.Printf("Slab file:    %s\n", sf.Filename)
+	fmt.Printf("Metadata:     from %s, version %d\n", source, md.Version)
+	fmt.Printf("Size:         %d x %d x %d voxels\n", md.Size[0], md.Size[1], md.Size[2])
+	fmt.Printf("Origin:       (%d, %d, %d)\n", md.Origin[0], md.Origin[1], md.Origin[2])
+	fmt.Printf("Valid extent: (%d, %d, %d) to (%d, %d, %d)\n", md.ValidMin[0], md.ValidMin[1], md.ValidMin[2],
+		md.ValidMax[0]-1, md.ValidMax[1]-1, md.ValidMax[2]-1)
+	fmt.Printf("Labels:       %s %s, %s order, %s compression\n", md.ByteOrder, md.DataType, md.Order, md.Compression)
+	if sf.HasSidecar {
+		fmt.Printf("Bytes:        %d compressed to %d\n", md.Bytes, md.CompressedBytes)
+		fmt.Printf("Body offset:  %d\n", md.BodyOffset)
+	}
+
+	bodies := sf.BodyCounts()
+	fmt.Printf("Bodies:       %d distinct labels\n\n", len(bodies))
+	fmt.Printf("%20s %12s\n", "body", "voxels")
+	for _, b := range bodies {
+		fmt.Printf("%20d %12d\n", b.Body, b.Voxels)
+	}
+	return nil
+}
+
+func verifySlabs(args []string) error {
+	opts := exportOptions()
+	opts.SuperpixelToSegment = args[0]
+	opts.SegmentToBody = args[1]
+	opts.SuperpixelDir = args[2]
+	v, err := exporter.VerifySlabs(opts, args[3])
+	if err != nil {
+		return err
+	}
+	v.Report(os.Stdout)
+	if !v.OK() {
+		return fmt.Errorf("exported slabs don't match the Raveler session")
+	}
+	return nil
+}
+
+func auditDVID(args []string) error {
+	c, err := exporter.AuditDVID(exportOptions().DVIDClient(), args[0], args[1])
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(args[1], "dvid-audit.json")
+	if err := c.WriteJSON(filename); err != nil {
+		return err
+	}
+	fmt.Printf("%s\nWrote report to %s\n", c.Summary(), filename)
+	if !c.OK() {
+		return fmt.Errorf("slabs in DVID differ from the slab files")
+	}
+	return nil
+}
+
+// inspectCompiledMap checks all of a compiled map and summarizes it.
+func inspectCompiledMap(filename string) error {
+	if err := exporter.VerifyCompiledMap(filename); err != nil {
+		return err
+	}
+	table, err := exporter.OpenCompiledMap(filename)
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	zs := table.Zs()
+	fmt.Printf("Compiled map: %s\n", filename)
+	fmt.Printf("Checksum:     OK\n")
+	fmt.Printf("Superpixels:  %d in %d slices\n", table.NumSuperpixels(), table.NumSlices())
+	if len(zs) != 0 {
+		fmt.Printf("Z range:      %d to %d\n", zs[0], zs[len(zs)-1])
+	}
+	fmt.Printf("Bodies:       %d distinct labels\n", table.NumBodies())
+	return nil
+}
@@ -0,0 +1,230 @@
+package exporter
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// bandExport holds the state of a memory-bounded export across layers.
+type bandExport struct {
+	e       *Exporter
+	sp2body *BodyTable
+	roi     *roiMask
+
+	writer *layerWriter
+	nx, ny int // slice size
+	bandY  int // # of rows in a band, a multiple of SlabY
+}
+
+// transformBands is the memory-bounded form of transformImages for slices too large
+// to hold a whole layer of SlabZ slices in memory.  The superpixel images of a layer
+// are read one row at a time, and the layer is relabeled and written in bands of slab
+// rows whose height is chosen so the export fits in MemLimit.  Each image is still
+// decoded only once.
+func (e *Exporter) transformBands(sp2body *BodyTable, roi *roiMask, unmapped *UnmappedReport) error {
+	src, ok := e.source.(*PNGDirSource)
+	if !ok {
+		return fmt.Errorf("memory-bounded export requires a superpixel PNG directory")
+	}
+	files, err := src.files(e.opts.MinZ, e.opts.MaxZ)
+	if err != nil {
+		return err
+	}
+
+	// Group the images into layers of slabZ slices.
+	var layers [][]pngFile
+	for _, f := range files {
+		n := len(layers)
+		if n > 0 && e.opts.ZHead(layers[n-1][0].z) == e.opts.ZHead(f.z) {
+			layers[n-1] = append(layers[n-1], f)
+		} else {
+			layers = append(layers, []pngFile{f})
+		}
+	}
+
+	be := &bandExport{e: e, sp2body: sp2body, roi: roi}
+	for _, layer := range layers {
+		if err = be.transformLayer(layer, unmapped); err != nil {
+			break
+		}
+	}
+	if be.writer != nil {
+		if werr := be.writer.close(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// slabMemory returns the approximate memory used by slabs being packed, compressed,
+// and sent at once.
+func (opts Options) slabMemory() int64 {
+	slabBytes := int64(opts.SlabX) * int64(opts.SlabY) * int64(opts.SlabZ) * 8
+	inflight := int64(opts.SlabWorkers) * slabBytes
+	if opts.MaxInflightBytes > 0 && inflight > opts.MaxInflightBytes {
+		inflight = opts.MaxInflightBytes
+		if inflight < slabBytes {
+			inflight = slabBytes
+		}
+	}
+	return 2 * inflight // include compressed copies of the slabs
+}
+
+// bandMemory returns the number of rows per band that keeps a memory-bounded export
+// of nx by ny slices within MemLimit, and the approximate memory used.  The memory
+// includes the body table, the band buffers, the slabs in flight, and the row
+// buffers of the images being read.
+func (opts Options) bandMemory(nx, ny int, tableBytes int64) (bandY int, bytes int64, err error) {
+	readers := int64(opts.SlabZ) * (3*4*int64(nx) + 256<<10)
+	workers := int64(opts.RelabelWorkers) * 4 * int64(nx)
+	fixed := tableBytes + opts.slabMemory() + readers + workers
+
+	slabRowBytes := int64(opts.WriteQueue+1) * int64(nx) * int64(opts.SlabY) * int64(opts.SlabZ) * 8
+	slabRows := (opts.MemLimit - fixed) / slabRowBytes
+	if slabRows < 1 {
+		return 0, fixed + slabRowBytes, fmt.Errorf("memory limit of %s is too small for %d pixel wide slices: need at least %s",
+			humanBytes(opts.MemLimit), nx, humanBytes(fixed+slabRowBytes))
+	}
+	maxRows := (int64(ny) + int64(opts.SlabY) - 1) / int64(opts.SlabY)
+	if slabRows > maxRows {
+		slabRows = maxRows
+	}
+	bandY = int(slabRows) * opts.SlabY
+	if bandY > ny {
+		bandY = ny
+	}
+	return bandY, fixed + slabRows*slabRowBytes, nil
+}
+
+// transformLayer relabels and writes the bands of one layer of images.
+func (be *bandExport) transformLayer(files []pngFile, unmapped *UnmappedReport) error {
+	e := be.e
+	tlog := NewTimeLog()
+	zoffset := e.opts.ZHead(files[0].z)
+
+	readers := make([]*pngRowReader, len(files))
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				r.Close()
+			}
+		}
+	}()
+	relabelers := make([]*relabeler, len(files))
+	for i, f := range files {
+		r, err := openPNGRows(f.path)
+		if err != nil {
+			return err
+		}
+		readers[i] = r
+		relabelers[i] = e.newRelabeler(be.sp2body, f.z)
+
+		if be.writer == nil {
+			be.nx, be.ny = r.width, r.height
+			var bytes int64
+			if be.bandY, bytes, err = e.opts.bandMemory(be.nx, be.ny, int64(be.sp2body.Bytes())); err != nil {
+				return err
+			}
+			fmt.Printf("Processing %d x %d slices in bands of %d rows using about %s\n",
+				be.nx, be.ny, be.bandY, humanBytes(bytes))
+			be.writer = e.newLayerWriter(be.nx*be.bandY*e.opts.SlabZ, be.roi)
+		} else if r.width != be.nx || r.height != be.ny {
+			return fmt.Errorf("superpixel image changes sizes: expected %d x %d and got %d x %d: %s",
+				be.nx, be.ny, r.width, r.height, f.path)
+		}
+	}
+
+	for y0 := 0; y0 < be.ny; y0 += be.bandY {
+		y1 := y0 + be.bandY
+		if y1 > be.ny {
+			y1 = be.ny
+		}
+		layer := layerT{buf: be.writer.buffer(), nx: be.nx, ny: y1 - y0, nz: e.opts.SlabZ, y0: y0,
+			z0: files[0].z, z1: files[len(files)-1].z + 1}
+		layer.nxy = layer.nx * layer.ny
+		layer.nxyz = layer.nxy * layer.nz
+		if err := be.relabelBand(files, readers, relabelers, layer); err != nil {
+			return err
+		}
+		if err := be.checkUnmapped(files, relabelers, unmapped); err != nil {
+			return err
+		}
+		if err := be.writer.write(layer, zoffset); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range files {
+		unmapped.addSlice(Plane{Z: f.z, Name: filepath.Base(f.path)}, relabelers[i].missing, e.opts)
+	}
+	tlog.Printf("Processed %d superpixel images for layer starting at Z %d", len(files), zoffset)
+	return nil
+}
+
+// checkUnmapped returns an error before a band is written if unmapped superpixels
+// are to stop the export and the band has any.  The slices of the layer are added to
+// the unmapped report with the superpixels found in the rows read so far.
+func (be *bandExport) checkUnmapped(files []pngFile, relabelers []*relabeler, unmapped *UnmappedReport) error {
+	if be.e.opts.Unmapped != UnmappedFail {
+		return nil
+	}
+	for i, f := range files {
+		if missing := relabelers[i].missing; len(missing) != 0 {
+			for j, f := range files {
+				unmapped.addSlice(Plane{Z: f.z, Name: filepath.Base(f.path)}, relabelers[j].missing, be.e.opts)
+			}
+			return fmt.Errorf("%d superpixels in slice %d are not in the mapping", len(missing), f.z)
+		}
+	}
+	return nil
+}
+
+// relabelBand reads the rows of a band from each image of a layer and stores their
+// bodies in the layer buffer.  Images are handled concurrently by the relabel workers,
+// and the error of the first failed image is returned.
+func (be *bandExport) relabelBand(files []pngFile, readers []*pngRowReader, relabelers []*relabeler, layer layerT) error {
+	e := be.e
+	errs := make([]error, len(files))
+	next := make(chan int, len(files))
+	for i := range files {
+		next <- i
+	}
+	close(next)
+
+	workers := e.opts.RelabelWorkers
+	if workers > len(files) {
+		workers = len(files)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids := make([]uint32, layer.nx)
+			var ranges []xRange
+			for i := range next {
+				z := files[i].z
+				dst := layer.buf[(z%layer.nz)*layer.nxy:]
+				for y := layer.y0; y < layer.y0+layer.ny; y++ {
+					if errs[i] = readers[i].next(ids); errs[i] != nil {
+						break
+					}
+					out := dst[(y-layer.y0)*layer.nx:]
+					ranges = rowRanges(be.roi, y, z, 0, layer.nx, ranges)
+					for _, xr := range ranges {
+						relabelers[i].relabel(ids[xr.x0:xr.x1], out[xr.x0:xr.x1])
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SliceBodies is the superpixel->body lookup for a single Z slice.  Since Raveler
+// superpixel labels within a slice are usually close to 1..N, a slice is stored as a
+// dense array indexed by label when that is cheap, and as sorted label and body index
+// arrays otherwise.  Either way, bodies are stored as 32-bit indices into the table's
+// list of distinct bodies.
+type SliceBodies struct {
+	bodies []uint64 // shared with the BodyTable
+
+	dense []uint32 // if non-nil, dense[label] is 1 + body index or 0 if unmapped.
+
+	labels []uint32 // sorted superpixel labels if not dense
+	index  []uint32 // body index for each label if not dense
+}
+
+// Body returns the body for a superpixel label in this slice.  A nil SliceBodies
+// has no mappings.  A body index outside the list of bodies, which only a corrupted
+// compiled map can have, is treated as unmapped.
+func (sb *SliceBodies) Body(label uint32) (body uint64, found bool) {
+	if sb == nil {
+		return 0, false
+	}
+	if sb.dense != nil {
+		if int(label) >= len(sb.dense) {
+			return 0, false
+		}
+		i := sb.dense[label]
+		if i == 0 || int(i) > len(sb.bodies) {
+			return 0, false
+		}
+		return sb.bodies[i-1], true
+	}
+	i := sort.Search(len(sb.labels), func(i int) bool { return sb.labels[i] >= label })
+	if i == len(sb.labels) || sb.labels[i] != label || int(sb.index[i]) >= len(sb.bodies) {
+		return 0, false
+	}
+	return sb.bodies[sb.index[i]], true
+}
+
+// NumLabels returns the number of superpixels mapped in this slice.
+func (sb *SliceBodies) NumLabels() int {
+	if sb == nil {
+		return 0
+	}
+	if sb.dense != nil {
+		var n int
+		for _, i := range sb.dense {
+			if i != 0 {
+				n++
+			}
+		}
+		return n
+	}
+	return len(sb.labels)
+}
+
+// Labels returns the mapped superpixel labels in this slice in increasing order.
+func (sb *SliceBodies) Labels() []uint32 {
+	if sb == nil {
+		return nil
+	}
+	if sb.dense == nil {
+		return append([]uint32(nil), sb.labels...)
+	}
+	var labels []uint32
+	for label, i := range sb.dense {
+		if i != 0 {
+			labels = append(labels, uint32(label))
+		}
+	}
+	return labels
+}
+
+func (sb *SliceBodies) bytes() int {
+	return 4 * (len(sb.dense) + len(sb.labels) + len(sb.index))
+}
+
+// BodyTable is a memory-efficient superpixel->body lookup table.  It takes about
+// 4 to 8 bytes per superpixel compared to the many tens of bytes per entry of a
+// map[Superpixel]uint64.
+type BodyTable struct {
+	bodies     []uint64
+	slices     map[uint32]*SliceBodies
+	numEntries int
+
+	closer func() error // releases a memory-mapped compiled map
+}
+
+// Close releases any memory-mapped data.  The table can't be used afterwards.
+func (t *BodyTable) Close() error {
+	if t.closer == nil {
+		return nil
+	}
+	err := t.closer()
+	t.closer = nil
+	t.bodies = nil
+	t.slices = nil
+	return err
+}
+
+// Slice returns the lookup for the given Z slice or nil if no superpixels in that
+// slice are mapped.
+func (t *BodyTable) Slice(z uint32) *SliceBodies {
+	return t.slices[z]
+}
+
+// Lookup returns the body for a superpixel.
+func (t *BodyTable) Lookup(sp Superpixel) (body uint64, found bool) {
+	return t.slices[sp.Slice].Body(sp.Label)
+}
+
+// Zs returns the Z slices with at least one superpixel in increasing order.
+func (t *BodyTable) Zs() []uint32 {
+	zs := make([]uint32, 0, len(t.slices))
+	for z := range t.slices {
+		zs = append(zs, z)
+	}
+	sort.Slice(zs, func(i, j int) bool { return zs[i] < zs[j] })
+	return zs
+}
+
+// NumSuperpixels returns the number of superpixels in the table.
+func (t *BodyTable) NumSuperpixels() int {
+	return t.numEntries
+}
+
+// NumBodies returns the number of distinct bodies in the table.
+func (t *BodyTable) NumBodies() int {
+	return len(t.bodies)
+}
+
+// NumSlices returns the number of Z slices with at least one superpixel.
+func (t *BodyTable) NumSlices() int {
+	return len(t.slices)
+}
+
+// Bytes returns the approximate memory used by the table, which for a compiled map
+// is the size of the memory-mapped data.
+func (t *BodyTable) Bytes() int {
+	n := 8 * len(t.bodies)
+	for _, sb := range t.slices {
+		n += sb.bytes() + 64 // include struct and map overhead
+	}
+	return n
+}
+
+// MemoryReport returns a one-line description of the table size.
+func (t *BodyTable) MemoryReport() string {
+	var bytesPerSp float64
+	if t.numEntries != 0 {
+		bytesPerSp = float64(t.Bytes()) / float64(t.numEntries)
+	}
+	return fmt.Sprintf("superpixel->body table has %d superpixels in %d slices mapped to %d bodies using %s (%.1f bytes/superpixel)",
+		t.numEntries, len(t.slices), len(t.bodies), humanBytes(int64(t.Bytes())), bytesPerSp)
+}
+
+// BodyTableBuilder accumulates superpixel->body mappings and then builds a BodyTable.
+// If a superpixel is added more than once, the last mapping is kept.
+type BodyTableBuilder struct {
+	bodyIndex map[uint64]uint32
+	bodies    []uint64
+	entries   map[uint32][]uint64 // label << 32 | body index, in order added
+}
+
+// NewBodyTableBuilder returns an empty builder.
+func NewBodyTableBuilder() *BodyTableBuilder {
+	return &BodyTableBuilder{
+		bodyIndex: make(map[uint64]uint32),
+		entries:   make(map[uint32][]uint64),
+	}
+}
+
+// Add stores a superpixel->body mapping.
+func (b *BodyTableBuilder) Add(sp Superpixel, body uint64) {
+	i, found := b.bodyIndex[body]
+	if !found {
+		i = uint32(len(b.bodies))
+		b.bodyIndex[body] = i
+		b.bodies = append(b.bodies, body)
+	}
+	b.entries[sp.Slice] = append(b.entries[sp.Slice], uint64(sp.Label)<<32|uint64(i))
+}
+
+// Build returns the lookup table.  The builder should not be used afterwards.
+func (b *BodyTableBuilder) Build() *BodyTable {
+	t := &BodyTable{
+		bodies: b.bodies,
+		slices: make(map[uint32]*SliceBodies, len(b.entries)),
+	}
+	for z, entries := range b.entries {
+		// Sort by label, keeping the last added of duplicate labels.
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i]>>32 < entries[j]>>32 })
+		n := 0
+		for i := range entries {
+			if n > 0 && entries[n-1]>>32 == entries[i]>>32 {
+				entries[n-1] = entries[i]
+			} else {
+				entries[n] = entries[i]
+				n++
+			}
+		}
+		entries = entries[:n]
+
+		sb := &SliceBodies{bodies: t.bodies}
+		maxLabel := entries[n-1] >> 32
+		if maxLabel < uint64(2*n) {
+			sb.dense = make([]uint32, maxLabel+1)
+			for _, entry := range entries {
+				sb.dense[entry>>32] = uint32(entry) + 1
+			}
+		} else {
+			sb.labels = make([]uint32, n)
+			sb.index = make([]uint32, n)
+			for i, entry := range entries {
+				sb.labels[i] = uint32(entry >> 32)
+				sb.index[i] = uint32(entry)
+			}
+		}
+		t.slices[z] = sb
+		t.numEntries += n
+		delete(b.entries, z)
+	}
+	b.bodyIndex = nil
+	return t
+}
+
+// humanBytes returns a byte count in human-readable form, e.g., "1.5 GiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,81 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testBodyTable returns a table with a dense slice 1, a sorted slice 2, and the
+// mappings it was built from.
+func testBodyTable() (*BodyTable, map[Superpixel]uint64) {
+	want := make(map[Superpixel]uint64)
+	for label := uint32(1); label <= 20; label++ {
+		if label != 7 {
+			want[Superpixel{1, label}] = 100 + uint64(label%3)
+		}
+	}
+	for _, label := range []uint32{5, 1000, 70000, 0xFFFFFF} {
+		want[Superpixel{2, label}] = uint64(label%2+1) << 40
+	}
+
+	b := NewBodyTableBuilder()
+	b.Add(Superpixel{1, 3}, 101) // replaced by the later mapping
+	for sp, body := range want {
+		b.Add(sp, body)
+	}
+	return b.Build(), want
+}
+
+func TestBodyTableLookup(t *testing.T) {
+	table, want := testBodyTable()
+	if table.Slice(1).dense == nil {
+		t.Errorf("slice of consecutive labels not stored densely")
+	}
+	if table.Slice(2).dense != nil {
+		t.Errorf("slice of sparse labels stored densely")
+	}
+	checkBodyTable(t, "built", table, want)
+}
+
+// checkBodyTable checks that a table holds exactly the given mappings for slices
+// 0 to 3.
+func checkBodyTable(t *testing.T, name string, table *BodyTable, want map[Superpixel]uint64) {
+	t.Helper()
+	for sp, body := range want {
+		if got, found := table.Lookup(sp); !found || got != body {
+			t.Errorf("%s: superpixel %v has body %d (found %t), expected %d", name, sp, got, found, body)
+		}
+	}
+	for _, sp := range []Superpixel{{1, 0}, {1, 7}, {1, 21}, {1, 1 << 20}, {2, 6}, {2, 999}, {2, 1 << 30}, {0, 1}, {3, 5}} {
+		if body, found := table.Lookup(sp); found {
+			t.Errorf("%s: unmapped superpixel %v has body %d", name, sp, body)
+		}
+	}
+	if table.NumSuperpixels() != len(want) {
+		t.Errorf("%s: table has %d superpixels, expected %d", name, table.NumSuperpixels(), len(want))
+	}
+	if table.NumBodies() != 5 {
+		t.Errorf("%s: table has %d bodies, expected 5", name, table.NumBodies())
+	}
+	if zs := table.Zs(); !reflect.DeepEqual(zs, []uint32{1, 2}) {
+		t.Errorf("%s: table has slices %v, expected [1 2]", name, zs)
+	}
+	for _, z := range table.Zs() {
+		var labels []uint32
+		for sp := range want {
+			if sp.Slice == z {
+				labels = append(labels, sp.Label)
+			}
+		}
+		got := table.Slice(z).Labels()
+		if len(got) != len(labels) || table.Slice(z).NumLabels() != len(labels) {
+			t.Errorf("%s: slice %d has %d labels, expected %d", name, z, len(got), len(labels))
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i] <= got[i-1] {
+				t.Errorf("%s: slice %d labels out of order: %v", name, z, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package exporter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// A compiled map is a binary form of a BodyTable that export jobs can memory-map
+// instead of parsing the Raveler text maps.  All values are little-endian:
+//
+//	Header (48 bytes)
+//	  8 bytes       magic "RAVBODY\x00"
+//	  uint32        format version
+//	  uint32        reserved
+//	  uint64        # of bodies (Nb)
+//	  uint64        # of slices (Ns)
+//	  uint64        # of superpixels
+//	  uint32        CRC-32C checksum of everything after the header
+//	  uint32        reserved
+//
+//	Nb * uint64     distinct bodies
+//
+//	Ns * slice entry, in increasing Z:
+//	  uint32        Z
+//	  uint32        kind: 0 = dense, 1 = sorted labels
+//	  uint64        # of array elements (N)
+//	  uint64        byte offset of the slice arrays from start of file
+//
+//	Slice arrays, in order of the slice entries:
+//	  dense:        N * uint32 of 1 + body index, or 0 if label is unmapped
+//	  sorted:       N * uint32 sorted labels, then N * uint32 body indices
+const (
+	compiledMapMagic      = "RAVBODY\x00"
+	compiledMapVersion    = 1
+	compiledMapHeaderSize = 48
+	compiledMapEntrySize  = 24
+
+	sliceKindDense  = 0
+	sliceKindSorted = 1
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteCompiledMap writes a body table in compiled binary form.  The file is written
+// to a temporary name and renamed when complete.
+func WriteCompiledMap(t *BodyTable, filename string) error {
+	tlog := NewTimeLog()
+
+	tmpname := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+	defer f.Close()
+
+	zs := t.Zs()
+
+	// Write everything after the header while computing its checksum.
+	if _, err := f.Seek(compiledMapHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	crc := crc32.New(crc32c)
+	w := bufio.NewWriterSize(io.MultiWriter(f, crc), 1<<20)
+
+	if err := binary.Write(w, binary.LittleEndian, t.bodies); err != nil {
+		return err
+	}
+	offset := uint64(compiledMapHeaderSize + 8*len(t.bodies) + compiledMapEntrySize*len(zs))
+	entry := make([]byte, compiledMapEntrySize)
+	for _, z := range zs {
+		sb := t.slices[z]
+		kind, n := uint32(sliceKindDense), uint64(len(sb.dense))
+		if sb.dense == nil {
+			kind, n = sliceKindSorted, uint64(len(sb.labels))
+		}
+		binary.LittleEndian.PutUint32(entry[0:4], z)
+		binary.LittleEndian.PutUint32(entry[4:8], kind)
+		binary.LittleEndian.PutUint64(entry[8:16], n)
+		binary.LittleEndian.PutUint64(entry[16:24], offset)
+		if _, err := w.Write(entry); err != nil {
+			return err
+		}
+		offset += uint64(sb.bytes())
+	}
+	for _, z := range zs {
+		sb := t.slices[z]
+		for _, data := range [][]uint32{sb.dense, sb.labels, sb.index} {
+			if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, compiledMapHeaderSize)
+	copy(header[0:8], compiledMapMagic)
+	binary.LittleEndian.PutUint32(header[8:12], compiledMapVersion)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(len(t.bodies)))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(len(zs)))
+	binary.LittleEndian.PutUint64(header[32:40], uint64(t.numEntries))
+	binary.LittleEndian.PutUint32(header[40:44], crc.Sum32())
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		return err
+	}
+	tlog.Printf("Wrote compiled superpixel->body map, %s", filename)
+	return nil
+}
+
+// OpenCompiledMap memory-maps a compiled map written by WriteCompiledMap and
+// returns it as a body table.  The table should be closed when no longer needed.
+// Only the header and slice directory are read, so pages of the map are loaded as
+// superpixels are looked up.  The checksum isn't checked, since that would read the
+// whole map from shared storage in every export job; compile-map verifies the map
+// once after writing it, and VerifyCompiledMap rechecks a copy.  Slice ranges are
+// checked against the file size and body indices are checked as they are used, so
+// a corrupted map gives an error or unmapped superpixels rather than a crash.
+func OpenCompiledMap(filename string) (*BodyTable, error) {
+	tlog := NewTimeLog()
+
+	data, unmap, err := mapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseCompiledMap(data, filename, false)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	t.closer = unmap
+	tlog.Printf("Opened compiled superpixel->body map, %s", filename)
+	fmt.Printf("Loaded %s\n", t.MemoryReport())
+	return t, nil
+}
+
+// VerifyCompiledMap reads all of a compiled map, checking its checksum and that every
+// body index is within the list of bodies.
+func VerifyCompiledMap(filename string) error {
+	tlog := NewTimeLog()
+
+	data, unmap, err := mapFile(filename)
+	if err != nil {
+		return err
+	}
+	defer unmap()
+	if _, err := parseCompiledMap(data, filename, true); err != nil {
+		return err
+	}
+	tlog.Printf("Verified compiled superpixel->body map, %s", filename)
+	return nil
+}
+
+// CompiledMapChecksum returns the checksum stored in a compiled map's header, which
+// identifies its contents without reading the whole file.
+func CompiledMapChecksum(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, compiledMapHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[0:8]) != compiledMapMagic {
+		return "", fmt.Errorf("%s is not a compiled superpixel->body map", filename)
+	}
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(header[40:44])), nil
+}
+
+// IsCompiledMap returns true if a file starts with the compiled map magic number.
+func IsCompiledMap(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(compiledMapMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == compiledMapMagic
+}
+
+// parseCompiledMap returns a body table using the compiled map data in place after
+// checking that the slice directory and each slice's arrays lie within the data.  If
+// verify is true, it also checks the checksum and body indices, which reads the
+// whole map.
+func parseCompiledMap(data []byte, filename string, verify bool) (*BodyTable, error) {
+	if len(data) < compiledMapHeaderSize || string(data[0:8]) != compiledMapMagic {
+		return nil, fmt.Errorf("%s is not a compiled superpixel->body map", filename)
+	}
+	if version := binary.LittleEndian.Uint32(data[8:12]); version != compiledMapVersion {
+		return nil, fmt.Errorf("compiled map %s has version %d, expected %d", filename, version, compiledMapVersion)
+	}
+	numBodies := binary.LittleEndian.Uint64(data[16:24])
+	numSlices := binary.LittleEndian.Uint64(data[24:32])
+	numEntries := binary.LittleEndian.Uint64(data[32:40])
+	checksum := binary.LittleEndian.Uint32(data[40:44])
+	if verify && crc32.Checksum(data[compiledMapHeaderSize:], crc32c) != checksum {
+		return nil, fmt.Errorf("compiled map %s is corrupted: checksum mismatch", filename)
+	}
+	if numBodies > 1<<32 {
+		return nil, fmt.Errorf("compiled map %s has too many bodies: %d", filename, numBodies)
+	}
+
+	size := uint64(len(data))
+	bodiesEnd := compiledMapHeaderSize + 8*numBodies
+	if bodiesEnd > size || numSlices > (size-bodiesEnd)/compiledMapEntrySize {
+		return nil, fmt.Errorf("compiled map %s is truncated", filename)
+	}
+	dirEnd := bodiesEnd + compiledMapEntrySize*numSlices
+	t := &BodyTable{
+		bodies:     uint64s(data[compiledMapHeaderSize:bodiesEnd]),
+		slices:     make(map[uint32]*SliceBodies, numSlices),
+		numEntries: int(numEntries),
+	}
+	for i := uint64(0); i < numSlices; i++ {
+		entry := data[bodiesEnd+i*compiledMapEntrySize:]
+		z := binary.LittleEndian.Uint32(entry[0:4])
+		kind := binary.LittleEndian.Uint32(entry[4:8])
+		n := binary.LittleEndian.Uint64(entry[8:16])
+		offset := binary.LittleEndian.Uint64(entry[16:24])
+
+		// The arrays must follow the directory, be aligned for use in place, and
+		// end within the data, checked so that no sum can overflow.
+		elemBytes := uint64(4)
+		switch kind {
+		case sliceKindDense:
+		case sliceKindSorted:
+			elemBytes = 8
+		default:
+			return nil, fmt.Errorf("compiled map %s has unknown slice kind %d", filename, kind)
+		}
+		if offset < dirEnd || offset > size || offset%4 != 0 || n > (size-offset)/elemBytes {
+			return nil, fmt.Errorf("compiled map %s is corrupted or truncated at slice %d", filename, z)
+		}
+		sb := &SliceBodies{bodies: t.bodies}
+		if kind == sliceKindDense {
+			sb.dense = uint32s(data[offset : offset+4*n])
+		} else {
+			sb.labels = uint32s(data[offset : offset+4*n])
+			sb.index = uint32s(data[offset+4*n : offset+8*n])
+		}
+		if verify {
+			if err := sb.checkIndices(); err != nil {
+				return nil, fmt.Errorf("compiled map %s is corrupted at slice %d: %s", filename, z, err.Error())
+			}
+		}
+		t.slices[z] = sb
+	}
+	return t, nil
+}
+
+// checkIndices returns an error if any body index of the slice is outside the list of
+// bodies or the sorted labels are out of order.
+func (sb *SliceBodies) checkIndices() error {
+	n := uint64(len(sb.bodies))
+	for label, i := range sb.dense {
+		if uint64(i) > n {
+			return fmt.Errorf("label %d has body index %d of %d bodies", label, int64(i)-1, n)
+		}
+	}
+	for j, i := range sb.index {
+		if uint64(i) >= n {
+			return fmt.Errorf("label %d has body index %d of %d bodies", sb.labels[j], i, n)
+		}
+		if j > 0 && sb.labels[j] <= sb.labels[j-1] {
+			return fmt.Errorf("labels %d and %d are out of order", sb.labels[j-1], sb.labels[j])
+		}
+	}
+	return nil
+}
+
+// littleEndianHost is true if the host stores integers little-endian, so compiled
+// map data can be used in place.
+var littleEndianHost = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// uint32s and uint64s reinterpret little-endian file data in place, which relies on
+// the suitably aligned data given by the compiled map layout.  On a big-endian host,
+// they return decoded copies instead.
+func uint32s(b []byte) []uint32 {
+	if len(b) == 0 {
+		return nil
+	}
+	if !littleEndianHost {
+		out := make([]uint32, len(b)/4)
+		for i := range out {
+			out[i] = binary.LittleEndian.Uint32(b[4*i:])
+		}
+		return out
+	}
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&b[0])), len(b)/4)
+}
+
+func uint64s(b []byte) []uint64 {
+	if len(b) == 0 {
+		return nil
+	}
+	if !littleEndianHost {
+		out := make([]uint64, len(b)/8)
+		for i := range out {
+			out[i] = binary.LittleEndian.Uint64(b[8*i:])
+		}
+		return out
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), len(b)/8)
+}
@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestCompiledMap writes the compiled form of testBodyTable and returns its
+// filename, contents and the mappings it holds.
+func writeTestCompiledMap(t *testing.T) (string, []byte, map[Superpixel]uint64) {
+	table, want := testBodyTable()
+	filename := filepath.Join(t.TempDir(), "sp2body.ravbody")
+	if err := WriteCompiledMap(table, filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename, data, want
+}
+
+func TestCompiledMapRoundTrip(t *testing.T) {
+	filename, data, want := writeTestCompiledMap(t)
+	if !IsCompiledMap(filename) {
+		t.Errorf("%s not recognized as a compiled map", filename)
+	}
+	if err := VerifyCompiledMap(filename); err != nil {
+		t.Fatal(err)
+	}
+	table, err := OpenCompiledMap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	checkBodyTable(t, "compiled", table, want)
+
+	checksum, err := CompiledMapChecksum(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := crc32.Checksum(data[compiledMapHeaderSize:], crc32c); checksum != fmt.Sprintf("%08x", sum) {
+		t.Errorf("checksum %s doesn't match contents %08x", checksum, sum)
+	}
+}
+
+// TestCompiledMapChecksum checks that verifying finds a changed byte that opening,
+// which doesn't read the whole map, can't.
+func TestCompiledMapChecksum(t *testing.T) {
+	filename, data, _ := writeTestCompiledMap(t)
+	data[len(data)-1] ^= 1
+	writeTestFile(t, filename, data)
+	if err := VerifyCompiledMap(filename); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	table, err := OpenCompiledMap(filename)
+	if err != nil {
+		t.Fatalf("map with changed data couldn't be opened: %v", err)
+	}
+	table.Close()
+}
+
+// TestCompiledMapCorrupted checks that truncated maps and maps with bad slice
+// entries or body indices give errors rather than crashing.
+func TestCompiledMapCorrupted(t *testing.T) {
+	filename, data, want := writeTestCompiledMap(t)
+
+	// The slice directory follows the header and 5 bodies, and slice 1's dense array
+	// follows the directory of 2 slices.
+	const dirStart = compiledMapHeaderSize + 8*5
+	const denseStart = dirStart + 2*compiledMapEntrySize
+	if z := binary.LittleEndian.Uint32(data[dirStart:]); z != 1 || binary.LittleEndian.Uint32(data[dirStart+4:]) != sliceKindDense {
+		t.Fatalf("unexpected layout of compiled map: first slice is %d", z)
+	}
+
+	// rewrite writes a changed copy of the map with an updated checksum.
+	rewrite := func(change func(b []byte) []byte) {
+		b := change(append([]byte(nil), data...))
+		if len(b) >= compiledMapHeaderSize {
+			binary.LittleEndian.PutUint32(b[40:44], crc32.Checksum(b[compiledMapHeaderSize:], crc32c))
+		}
+		writeTestFile(t, filename, b)
+	}
+
+	for _, n := range []int{0, 7, compiledMapHeaderSize - 1, dirStart - 1, denseStart - 1, denseStart + 3, len(data) - 1} {
+		rewrite(func(b []byte) []byte { return b[:n] })
+		if table, err := OpenCompiledMap(filename); err == nil {
+			table.Close()
+			t.Errorf("map truncated to %d of %d bytes opened without error", n, len(data))
+		}
+		if err := VerifyCompiledMap(filename); err == nil {
+			t.Errorf("map truncated to %d of %d bytes verified without error", n, len(data))
+		}
+	}
+
+	for name, change := range map[string]func(b []byte){
+		"slice offset past end":   func(b []byte) { binary.LittleEndian.PutUint64(b[dirStart+16:], 1<<63) },
+		"slice offset in header":  func(b []byte) { binary.LittleEndian.PutUint64(b[dirStart+16:], 8) },
+		"unaligned slice offset":  func(b []byte) { binary.LittleEndian.PutUint64(b[dirStart+16:], denseStart+2) },
+		"slice length past end":   func(b []byte) { binary.LittleEndian.PutUint64(b[dirStart+8:], 1<<62) },
+		"unknown slice kind":      func(b []byte) { binary.LittleEndian.PutUint32(b[dirStart+4:], 7) },
+		"too many slices":         func(b []byte) { binary.LittleEndian.PutUint64(b[24:32], 1<<60) },
+		"too many bodies":         func(b []byte) { binary.LittleEndian.PutUint64(b[16:24], 1<<40) },
+		"unsupported version":     func(b []byte) { binary.LittleEndian.PutUint32(b[8:12], 99) },
+		"not a compiled map file": func(b []byte) { b[0] = 'X' },
+	} {
+		rewrite(func(b []byte) []byte { change(b); return b })
+		if table, err := OpenCompiledMap(filename); err == nil {
+			table.Close()
+			t.Errorf("%s: map opened without error", name)
+		}
+	}
+
+	// A bad body index is only found by verifying, and is otherwise unmapped.
+	rewrite(func(b []byte) []byte {
+		binary.LittleEndian.PutUint32(b[denseStart+4:], 100)
+		return b
+	})
+	if err := VerifyCompiledMap(filename); err == nil || !strings.Contains(err.Error(), "corrupted at slice 1") {
+		t.Errorf("expected bad body index in slice 1, got %v", err)
+	}
+	table, err := OpenCompiledMap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if body, found := table.Lookup(Superpixel{1, 1}); found {
+		t.Errorf("superpixel with bad body index has body %d", body)
+	}
+	if body, found := table.Lookup(Superpixel{1, 2}); !found || body != want[Superpixel{1, 2}] {
+		t.Errorf("superpixel after bad body index has body %d, expected %d", body, want[Superpixel{1, 2}])
+	}
+}
@@ -0,0 +1,211 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocols for sending slabs to DVID.
+const (
+	ProtocolRaw    = "raw"    // POST each slab to the raw endpoint, for any labels type
+	ProtocolBlocks = "blocks" // POST compressed blocks to the blocks endpoint of labelarray or labelmap
+)
+
+// Size of the sub-blocks of DVID's compressed label block format.
+const subBlockSize = 8
+
+// encodeLabelBlock encodes a block of bs^3 labels in X, then Y, then Z order in DVID's
+// compressed label block format:
+//
+//	3 * uint32      # of sub-blocks along X, Y, and Z (gx, gy, gz)
+//	uint32          # of labels in the block (N)
+//	N * uint64      labels
+//
+// followed, if N > 1, by
+//
+//	Nsb * uint16    # of labels in each sub-block, where Nsb = gx * gy * gz
+//	Ns * uint32     indices into the N labels of each sub-block's labels
+//	Nsb * values    sub-block label index of each voxel, using ceil(log2(# sub-block
+//	                labels)) bits packed from the most significant bit, or nothing for
+//	                sub-blocks with one label.
+//
+// Sub-blocks are 8^3 voxels in Z, Y, X order, and voxels within a sub-block are in
+// Z, Y, X order.  All values are little-endian.
+func encodeLabelBlock(labels []uint64, bs int) []byte {
+	g := bs / subBlockSize
+	nsb := g * g * g
+	const sbVoxels = subBlockSize * subBlockSize * subBlockSize
+
+	// Index the block's labels and each sub-block's labels.
+	var blockLabels []uint64
+	blockIndex := make(map[uint64]uint32)
+	sbLabels := make([][]uint32, nsb) // block label indices of each sub-block's labels
+	sbValues := make([]uint16, nsb*sbVoxels)
+	var lastLabel uint64
+	var lastIndex uint32
+	haveLast := false
+	sb := 0
+	for gz := 0; gz < g; gz++ {
+		for gy := 0; gy < g; gy++ {
+			for gx := 0; gx < g; gx++ {
+				local := make(map[uint32]uint16)
+				values := sbValues[sb*sbVoxels : (sb+1)*sbVoxels]
+				v := 0
+				for z := gz * subBlockSize; z < (gz+1)*subBlockSize; z++ {
+					for y := gy * subBlockSize; y < (gy+1)*subBlockSize; y++ {
+						i := (z*bs+y)*bs + gx*subBlockSize
+						for _, label := range labels[i : i+subBlockSize] {
+							if !haveLast || label != lastLabel {
+								index, found := blockIndex[label]
+								if !found {
+									index = uint32(len(blockLabels))
+									blockIndex[label] = index
+									blockLabels = append(blockLabels, label)
+								}
+								lastLabel, lastIndex, haveLast = label, index, true
+							}
+							li, found := local[lastIndex]
+							if !found {
+								li = uint16(len(sbLabels[sb]))
+								local[lastIndex] = li
+								sbLabels[sb] = append(sbLabels[sb], lastIndex)
+							}
+							values[v] = li
+							v++
+						}
+					}
+				}
+				sb++
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	header := []uint32{uint32(g), uint32(g), uint32(g), uint32(len(blockLabels))}
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, blockLabels)
+	if len(blockLabels) < 2 {
+		return buf.Bytes()
+	}
+	for _, indices := range sbLabels {
+		binary.Write(&buf, binary.LittleEndian, uint16(len(indices)))
+	}
+	for _, indices := range sbLabels {
+		binary.Write(&buf, binary.LittleEndian, indices)
+	}
+	for sb, indices := range sbLabels {
+		bits := bitsFor(len(indices))
+		if bits == 0 {
+			continue
+		}
+		packed := make([]byte, sbVoxels*bits/8)
+		var bitpos int
+		for _, value := range sbValues[sb*sbVoxels : (sb+1)*sbVoxels] {
+			// Place the value's bits starting at bitpos, most significant first.
+			shifted := uint32(value) << uint(24-bits-bitpos%8)
+			i := bitpos / 8
+			packed[i] |= byte(shifted >> 16)
+			if i+1 < len(packed) {
+				packed[i+1] |= byte(shifted >> 8)
+			}
+			bitpos += bits
+		}
+		buf.Write(packed)
+	}
+	return buf.Bytes()
+}
+
+// bitsFor returns the number of bits needed to index n labels.
+func bitsFor(n int) int {
+	bits := 0
+	for (1 << uint(bits)) < n {
+		bits++
+	}
+	return bits
+}
+
+// encodeBlocks returns the body of a POST to the blocks endpoint for a slab: for each
+// block of the slab, its block coordinate as 3 * int32, the # of bytes of the block
+// as int32, and the gzipped block in compressed label block format.
+func encodeBlocks(slab Slab, bs int) ([]byte, error) {
+	nx, nxy := slab.Size[0], slab.Size[0]*slab.Size[1]
+	labels := make([]uint64, bs*bs*bs)
+	var body bytes.Buffer
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	for bz := 0; bz < slab.Size[2]/bs; bz++ {
+		for by := 0; by < slab.Size[1]/bs; by++ {
+			for bx := 0; bx < slab.Size[0]/bs; bx++ {
+				// Copy the block out of the slab.
+				for z := 0; z < bs; z++ {
+					for y := 0; y < bs; y++ {
+						si := ((bz*bs+z)*nxy + (by*bs+y)*nx + bx*bs) * 8
+						row := labels[(z*bs+y)*bs : (z*bs+y+1)*bs]
+						for x := range row {
+							row[x] = binary.LittleEndian.Uint64(slab.Data[si+x*8:])
+						}
+					}
+				}
+
+				zbuf.Reset()
+				zw.Reset(&zbuf)
+				if _, err := zw.Write(encodeLabelBlock(labels, bs)); err != nil {
+					return nil, err
+				}
+				if err := zw.Close(); err != nil {
+					return nil, err
+				}
+				coord := []int32{
+					int32(slab.Origin[0]/bs + bx),
+					int32(slab.Origin[1]/bs + by),
+					int32(slab.Origin[2]/bs + bz),
+					int32(zbuf.Len()),
+				}
+				binary.Write(&body, binary.LittleEndian, coord)
+				body.Write(zbuf.Bytes())
+			}
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// postBlocks sends a slab as compressed blocks to the blocks endpoint.
+func (ds *DVIDSink) postBlocks(slab Slab) error {
+	url := ds.URL + "/blocks"
+	out, err := encodeBlocks(slab, ds.BlockSize)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Attempting to POST %d blocks in %d bytes to %s for slab @ (%d,%d,%d)\n",
+		len(slab.Data)/(8*ds.BlockSize*ds.BlockSize*ds.BlockSize), len(out), url,
+		slab.Origin[0], slab.Origin[1], slab.Origin[2])
+	if ds.DryRun {
+		return nil
+	}
+	if _, err := ds.Client.Do("POST", url, out); err != nil {
+		return err
+	}
+	fmt.Printf("POSTed successfully %d bytes to %s\n", len(out), url)
+	return nil
+}
+
+// checkBlocksInstances checks that each DVID output sending compressed blocks is a
+// labelarray or labelmap instance, so an export to a labelblk instance, which has no
+// endpoint for them, fails before writing any slabs.
+func (e *Exporter) checkBlocksInstances() error {
+	for _, ds := range dvidSinks(e.sink) {
+		if ds.DryRun || ds.Protocol != ProtocolBlocks {
+			continue
+		}
+		typename, err := ds.instanceType()
+		if err != nil {
+			return err
+		}
+		if typename != "labelarray" && typename != "labelmap" {
+			return fmt.Errorf("the blocks protocol needs a labelarray or labelmap instance, but %s is %q; use -protocol=raw", ds.URL, typename)
+		}
+	}
+	return nil
+}
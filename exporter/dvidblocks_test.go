@@ -0,0 +1,285 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// decodeLabelBlock decodes a block in DVID's compressed label block format, reading
+// the packed values a bit at a time, and returns its labels in X, then Y, then Z order.
+func decodeLabelBlock(data []byte) ([]uint64, error) {
+	r := bytes.NewReader(data)
+	var header [4]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	gx, gy, gz, n := int(header[0]), int(header[1]), int(header[2]), int(header[3])
+	nx, ny, nz := gx*subBlockSize, gy*subBlockSize, gz*subBlockSize
+	blockLabels := make([]uint64, n)
+	if err := binary.Read(r, binary.LittleEndian, blockLabels); err != nil {
+		return nil, err
+	}
+	labels := make([]uint64, nx*ny*nz)
+	if n < 2 {
+		if n == 1 {
+			for i := range labels {
+				labels[i] = blockLabels[0]
+			}
+		}
+		return labels, expectEOF(r)
+	}
+
+	nsb := gx * gy * gz
+	counts := make([]uint16, nsb)
+	if err := binary.Read(r, binary.LittleEndian, counts); err != nil {
+		return nil, err
+	}
+	sbIndices := make([][]uint32, nsb)
+	for sb, count := range counts {
+		sbIndices[sb] = make([]uint32, count)
+		if err := binary.Read(r, binary.LittleEndian, sbIndices[sb]); err != nil {
+			return nil, err
+		}
+		for _, index := range sbIndices[sb] {
+			if int(index) >= n {
+				return nil, fmt.Errorf("sub-block %d has label index %d of %d labels", sb, index, n)
+			}
+		}
+	}
+
+	sb := 0
+	for sz := 0; sz < gz; sz++ {
+		for sy := 0; sy < gy; sy++ {
+			for sx := 0; sx < gx; sx++ {
+				indices := sbIndices[sb]
+				bits := 0
+				for 1<<uint(bits) < len(indices) {
+					bits++
+				}
+				var packed []byte
+				if bits > 0 {
+					packed = make([]byte, subBlockSize*subBlockSize*subBlockSize*bits/8)
+					if _, err := io.ReadFull(r, packed); err != nil {
+						return nil, fmt.Errorf("sub-block %d values: %s", sb, err.Error())
+					}
+				}
+				bitpos := 0
+				for z := sz * subBlockSize; z < (sz+1)*subBlockSize; z++ {
+					for y := sy * subBlockSize; y < (sy+1)*subBlockSize; y++ {
+						for x := sx * subBlockSize; x < (sx+1)*subBlockSize; x++ {
+							value := 0
+							for b := 0; b < bits; b++ {
+								bit := packed[bitpos/8] >> uint(7-bitpos%8) & 1
+								value = value<<1 | int(bit)
+								bitpos++
+							}
+							if value >= len(indices) {
+								return nil, fmt.Errorf("sub-block %d has value %d of %d labels", sb, value, len(indices))
+							}
+							labels[(z*ny+y)*nx+x] = blockLabels[indices[value]]
+						}
+					}
+				}
+				sb++
+			}
+		}
+	}
+	return labels, expectEOF(r)
+}
+
+func expectEOF(r *bytes.Reader) error {
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes left after block", r.Len())
+	}
+	return nil
+}
+
+// testBlocks returns blocks of bs^3 labels covering the cases of the block format.
+func testBlocks(bs int) map[string][]uint64 {
+	rng := rand.New(rand.NewSource(int64(bs)))
+	n := bs * bs * bs
+	blocks := map[string][]uint64{
+		"zero":      make([]uint64, n),
+		"solid":     make([]uint64, n),
+		"two":       make([]uint64, n),
+		"many":      make([]uint64, n),
+		"unique":    make([]uint64, n),
+		"subblocks": make([]uint64, n),
+	}
+	for i := 0; i < n; i++ {
+		x, y, z := i%bs, (i/bs)%bs, i/(bs*bs)
+		blocks["solid"][i] = 1<<40 + 17
+		if x+2*y > bs+z {
+			blocks["two"][i] = 1<<63 + 5
+		} else {
+			blocks["two"][i] = 3
+		}
+		blocks["many"][i] = uint64(1000 + rng.Intn(300))
+		blocks["unique"][i] = uint64(n-i) << 20 // every voxel of every sub-block different
+		// Sub-blocks with 1 to 9 labels, so each width of packed values up to 4 bits.
+		sb := (z/subBlockSize*(bs/subBlockSize)+y/subBlockSize)*(bs/subBlockSize) + x/subBlockSize
+		blocks["subblocks"][i] = uint64(sb*100 + rng.Intn(1+sb%9))
+	}
+	return blocks
+}
+
+// TestEncodeLabelBlock checks that decoding encoded blocks gives back their labels.
+func TestEncodeLabelBlock(t *testing.T) {
+	for _, bs := range []int{8, 16, 64} {
+		for name, labels := range testBlocks(bs) {
+			got, err := decodeLabelBlock(encodeLabelBlock(labels, bs))
+			if err != nil {
+				t.Fatalf("%s %d^3 block: %v", name, bs, err)
+			}
+			for i := range labels {
+				if got[i] != labels[i] {
+					t.Fatalf("%s %d^3 block: voxel %d decoded as %d, expected %d", name, bs, i, got[i], labels[i])
+				}
+			}
+		}
+	}
+
+	// A solid block is just the header and its label.
+	if data := encodeLabelBlock(testBlocks(16)["solid"], 16); len(data) != 4*4+8 {
+		t.Errorf("solid block encoded in %d bytes, expected %d", len(data), 4*4+8)
+	}
+}
+
+// decodeBlocks decodes the body of a POST to the blocks endpoint into a volume of
+// labels with the given size and origin.
+func decodeBlocks(data []byte, size, origin [3]int) ([]uint64, error) {
+	labels := make([]uint64, size[0]*size[1]*size[2])
+	filled := make([]bool, len(labels))
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var header [4]int32
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+		zdata := make([]byte, header[3])
+		if _, err := io.ReadFull(r, zdata); err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(zdata))
+		if err != nil {
+			return nil, err
+		}
+		block, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+		blockLabels, err := decodeLabelBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		bs := 1
+		for bs*bs*bs < len(blockLabels) {
+			bs++
+		}
+		for i, label := range blockLabels {
+			x := int(header[0])*bs + i%bs - origin[0]
+			y := int(header[1])*bs + (i/bs)%bs - origin[1]
+			z := int(header[2])*bs + i/(bs*bs) - origin[2]
+			if x < 0 || y < 0 || z < 0 || x >= size[0] || y >= size[1] || z >= size[2] {
+				return nil, fmt.Errorf("block (%d,%d,%d) is outside the slab", header[0], header[1], header[2])
+			}
+			v := (z*size[1]+y)*size[0] + x
+			if filled[v] {
+				return nil, fmt.Errorf("block (%d,%d,%d) sent twice", header[0], header[1], header[2])
+			}
+			labels[v], filled[v] = label, true
+		}
+	}
+	for v, ok := range filled {
+		if !ok {
+			return nil, fmt.Errorf("voxel %d of slab not in any block", v)
+		}
+	}
+	return labels, nil
+}
+
+// TestEncodeBlocks checks that the blocks sent for a slab decode to the slab,
+// including slabs at the edge of the volume that are padded with zeros.
+func TestEncodeBlocks(t *testing.T) {
+	const bs = 16
+	rng := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		name   string
+		size   [3]int
+		origin [3]int
+		valid  [3]int // voxels of real data along each axis, the rest is zero padding
+	}{
+		{"interior", [3]int{32, 48, 16}, [3]int{64, 32, 160}, [3]int{32, 48, 16}},
+		{"edge", [3]int{48, 32, 32}, [3]int{0, 96, 16}, [3]int{37, 5, 19}},
+	} {
+		slab := Slab{Data: make([]byte, 8*tc.size[0]*tc.size[1]*tc.size[2]), Origin: tc.origin, Size: tc.size}
+		want := make([]uint64, len(slab.Data)/8)
+		for i := range want {
+			x, y, z := i%tc.size[0], (i/tc.size[0])%tc.size[1], i/(tc.size[0]*tc.size[1])
+			if x < tc.valid[0] && y < tc.valid[1] && z < tc.valid[2] {
+				want[i] = uint64(1 + (x/5+y/3*7+z)%40 + rng.Intn(2))
+			}
+			binary.LittleEndian.PutUint64(slab.Data[8*i:], want[i])
+		}
+
+		data, err := encodeBlocks(slab, bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeBlocks(data, tc.size, tc.origin)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s: voxel %d decoded as %d, expected %d", tc.name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// TestBlocksInstanceType checks that exports with the blocks protocol are rejected
+// for labelblk instances before any slabs are sent, and that slab sizes the blocks
+// don't divide are rejected when validating.
+func TestBlocksInstanceType(t *testing.T) {
+	opts := sequential(writeTestSession(t, t.TempDir()))
+	opts.DVIDProtocol = ProtocolBlocks
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "-slabZ=64") {
+		t.Errorf("expected the default 64 block size to be rejected for %d-voxel slabs, got %v", opts.SlabZ, err)
+	}
+	opts.DVIDBlockSize = 8
+
+	for _, typename := range []string{"labelblk", "labelarray", "labelmap"} {
+		d, server := newTestDVID(t)
+		url := server.URL + "/api/node/abc/seg"
+		d.volumes["/api/node/abc/seg/info"] = []byte(`{"Base":{"TypeName":"` + typename + `","Name":"seg"},"Extended":{}}`)
+		ds := &DVIDSink{URL: url, Compression: "none", Client: testDVIDClient(), Protocol: ProtocolBlocks, BlockSize: 8}
+		e, err := NewWithSink(opts, ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run()
+		if typename == "labelblk" {
+			if err == nil || !strings.Contains(err.Error(), "labelarray or labelmap") {
+				t.Errorf("expected export to labelblk to fail, got %v", err)
+			}
+			if len(d.volumes) != 1 {
+				t.Errorf("%d slabs POSTed to labelblk before failing", len(d.volumes)-1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("export to %s failed: %v", typename, err)
+		}
+		if _, found := d.volumes["/api/node/abc/seg/blocks"]; !found {
+			t.Errorf("no blocks POSTed to %s", typename)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// Retry backoff bounds of a DVIDClient, which tests shorten.
+var (
+	dvidMinBackoff = 1 * time.Second
+	dvidMaxBackoff = 2 * time.Minute
+)
+
+// maxErrorBody is the most of a response body included in an error message.
+const maxErrorBody = 1024
+
+// DVIDClient sends requests to a DVID server, reusing connections and retrying
+// requests that fail from network errors, timeouts, or server errors.  Retries back
+// off exponentially with jitter, or wait as long as a Retry-After header asks.  A
+// server that is throttling requests with 429 or 503 responses is waited for without
+// using up the retries, since a busy server isn't a reason to give up on an export.
+type DVIDClient struct {
+	HTTP         *http.Client
+	MaxRetries   int           // retries after the first attempt, other than for throttling
+	ThrottleWait time.Duration // if positive, like Deadline but for retries of throttled requests
+	Deadline     time.Duration // if positive, no retry starts this long after the first attempt
+}
+
+// NewDVIDClient returns a client whose requests each time out after the given time and
+// that keeps up to maxConns idle connections to reuse.  Throttled requests are retried
+// without a time limit unless ThrottleWait is set.
+func NewDVIDClient(timeout time.Duration, maxRetries, maxConns int) *DVIDClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxConns
+	return &DVIDClient{
+		HTTP:       &http.Client{Transport: transport, Timeout: timeout},
+		MaxRetries: maxRetries,
+	}
+}
+
+// Do sends a request with an optional body and returns the body of a 200 response.
+func (c *DVIDClient) Do(method, url string, body []byte) ([]byte, error) {
+	start := time.Now()
+	var retries int
+	for attempt := 0; ; attempt++ {
+		data, retry, wait, err := c.try(method, url, body)
+		if err == nil {
+			return data, nil
+		}
+		if retry == retryNever || (retry == retryError && retries >= c.MaxRetries) {
+			return nil, err
+		}
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		elapsed := time.Since(start)
+		if (c.Deadline > 0 && elapsed+wait > c.Deadline) || (retry == retryThrottled && c.ThrottleWait > 0 && elapsed+wait > c.ThrottleWait) {
+			return nil, fmt.Errorf("%s (giving up after %s)", err.Error(), elapsed.Round(time.Second))
+		}
+		if retry == retryThrottled {
+			fmt.Printf("%s.  Server is busy, retrying in %s\n", err.Error(), wait.Round(time.Millisecond))
+		} else {
+			retries++
+			fmt.Printf("%s.  Retrying in %s (retry %d of %d)\n", err.Error(), wait.Round(time.Millisecond), retries, c.MaxRetries)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Whether a failed request may succeed if retried.
+const (
+	retryNever     = iota // the request itself is at fault
+	retryError            // network error, timeout, or server error
+	retryThrottled        // 429 or 503 response from a busy server
+)
+
+// try makes one attempt at a request.  On failure, it returns whether the request
+// may succeed if retried and how long the server asked to wait, if it did.
+func (c *DVIDClient) try(method, url string, body []byte) (data []byte, retry int, wait time.Duration, err error) {
+	var req *http.Request
+	if body != nil {
+		req, err = http.NewRequest(method, url, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+	} else {
+		req, err = http.NewRequest(method, url, nil)
+	}
+	if err != nil {
+		return nil, retryNever, 0, err
+	}
+
+	r, err := c.HTTP.Do(req)
+	if err != nil {
+		retry = retryNever
+		if retryable(err) {
+			retry = retryError
+		}
+		return nil, retry, 0, fmt.Errorf("%s %s failed: %s", method, url, err.Error())
+	}
+	data, err = ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, retryError, 0, fmt.Errorf("%s %s failed reading response: %s", method, url, err.Error())
+	}
+	if r.StatusCode == http.StatusOK {
+		return data, retryNever, 0, nil
+	}
+
+	if len(data) > maxErrorBody {
+		data = append(data[:maxErrorBody], "..."...)
+	}
+	err = fmt.Errorf("%s %s returned status %d: %s", method, url, r.StatusCode, bytes.TrimSpace(data))
+	switch r.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return nil, retryThrottled, retryAfter(r.Header.Get("Retry-After")), err
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return nil, retryError, retryAfter(r.Header.Get("Retry-After")), err
+	default:
+		return nil, retryNever, 0, err
+	}
+}
+
+// retryable returns true if a request error is a timeout or other network error,
+// rather than a problem with the request itself such as a malformed URL.
+func retryable(err error) bool {
+	if uerr, ok := err.(*neturl.Error); ok {
+		err = uerr.Err
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff returns the wait before a retry: an exponentially growing delay with
+// random jitter of up to half of it.
+func backoff(attempt int) time.Duration {
+	d := dvidMaxBackoff
+	if attempt < 16 {
+		if exp := dvidMinBackoff << uint(attempt); exp < d {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.  It
+// returns 0 if there is no usable header.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
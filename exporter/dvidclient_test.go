@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// statusServer responds to each request with the next of the given statuses, then
+// with 200 OK, and counts requests.
+type statusServer struct {
+	mu         sync.Mutex
+	statuses   []int
+	retryAfter string
+	requests   int
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if len(s.statuses) == 0 {
+		fmt.Fprint(w, "ok")
+		return
+	}
+	status := s.statuses[0]
+	if status != http.StatusNotFound {
+		s.statuses = s.statuses[1:]
+	}
+	if s.retryAfter != "" {
+		w.Header().Set("Retry-After", s.retryAfter)
+	}
+	http.Error(w, fmt.Sprintf("status %d", status), status)
+}
+
+// shortBackoff shortens the retry backoff for a test.
+func shortBackoff(t *testing.T) {
+	min, max := dvidMinBackoff, dvidMaxBackoff
+	dvidMinBackoff, dvidMaxBackoff = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { dvidMinBackoff, dvidMaxBackoff = min, max })
+}
+
+func repeat(status, n int) []int {
+	statuses := make([]int, n)
+	for i := range statuses {
+		statuses[i] = status
+	}
+	return statuses
+}
+
+func TestDVIDClientRetries(t *testing.T) {
+	shortBackoff(t)
+	for _, tc := range []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		throttleWait time.Duration
+		requests     int
+		err          string // expected error, if any
+	}{
+		{name: "server errors", statuses: []int{500, 502, 504}, maxRetries: 3, requests: 4},
+		{name: "too many server errors", statuses: []int{500, 502, 504}, maxRetries: 2, requests: 3, err: "returned status 504: status 504"},
+		{name: "not retried", statuses: []int{404}, maxRetries: 3, requests: 1, err: "returned status 404: status 404"},
+		{name: "throttled", statuses: repeat(503, 20), requests: 21},
+		{name: "throttled and errors", statuses: []int{429, 503, 500, 503, 429}, maxRetries: 1, requests: 6},
+		{name: "throttled too long", statuses: repeat(503, 1000), throttleWait: 50 * time.Millisecond, err: "giving up after"},
+	} {
+		s := &statusServer{statuses: tc.statuses}
+		server := httptest.NewServer(s)
+		c := NewDVIDClient(5*time.Second, tc.maxRetries, 1)
+		c.ThrottleWait = tc.throttleWait
+		data, err := c.Do("POST", server.URL+"/api/node/abc/seg/raw/0_1_2/8_4_2/0_0_0", []byte("slab"))
+		server.Close()
+
+		if tc.err == "" && (err != nil || string(data) != "ok") {
+			t.Errorf("%s: got %q, %v", tc.name, data, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+		}
+		if tc.requests != 0 && s.requests != tc.requests {
+			t.Errorf("%s: server got %d requests, expected %d", tc.name, s.requests, tc.requests)
+		}
+	}
+}
+
+// TestDVIDClientRetryAfter checks that a retry waits as long as the server asks.
+func TestDVIDClientRetryAfter(t *testing.T) {
+	shortBackoff(t)
+	s := &statusServer{statuses: []int{429}, retryAfter: "1"}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	start := time.Now()
+	if _, err := NewDVIDClient(5*time.Second, 0, 1).Do("GET", server.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, before the Retry-After of 1s", elapsed)
+	}
+
+	// A deadline shorter than the Retry-After gives up instead of waiting.
+	s.statuses, s.retryAfter = []int{503}, "60"
+	c := NewDVIDClient(5*time.Second, 0, 1)
+	c.Deadline = 10 * time.Second
+	if _, err := c.Do("GET", server.URL, nil); err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Errorf("expected to give up before the Retry-After, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"30", 30 * time.Second, 30 * time.Second},
+		{"-5", 0, 0},
+		{"1.5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	} {
+		if d := retryAfter(tc.header); d < tc.min || d > tc.max {
+			t.Errorf("Retry-After %q gave wait of %s, expected %s to %s", tc.header, d, tc.min, tc.max)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		max := dvidMaxBackoff
+		if attempt < 16 && dvidMinBackoff<<uint(attempt) < max {
+			max = dvidMinBackoff << uint(attempt)
+		}
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt); d < max/2 || d > max {
+				t.Fatalf("backoff for attempt %d is %s, expected %s to %s", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	// Find a port with nothing listening.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, dialErr := http.Get("http://" + addr)
+	_, schemeErr := http.Get("nosuch://" + addr)
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", dialErr, true},
+		{"timeout", &neturl.Error{Op: "Post", URL: "http://dvid", Err: &net.OpError{Op: "read", Err: errTimeout{}}}, true},
+		{"connection closed", &neturl.Error{Op: "Post", URL: "http://dvid", Err: io.EOF}, true},
+		{"truncated response", io.ErrUnexpectedEOF, true},
+		{"unsupported scheme", schemeErr, false},
+		{"other error", errors.New("bad request"), false},
+	} {
+		if tc.err == nil {
+			t.Fatalf("%s: no error", tc.name)
+		}
+		if got := retryable(tc.err); got != tc.want {
+			t.Errorf("%s: retryable(%v) is %t", tc.name, tc.err, got)
+		}
+	}
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
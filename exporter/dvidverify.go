@@ -0,0 +1,241 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// DVIDMismatch describes a slab that DVID returned differently from how it was sent.
+type DVIDMismatch struct {
+	Origin [3]int `json:"origin"`
+	Size   [3]int `json:"size"`
+	URL    string `json:"url"`
+
+	Error    string `json:"error,omitempty"`  // failed read-back, if any
+	Voxels   int    `json:"voxels,omitempty"` // # of voxels that differ
+	First    [3]int `json:"first"`            // first differing voxel
+	Sent     uint64 `json:"sent"`             // label sent for the first differing voxel
+	Received uint64 `json:"received"`         // label read back for it
+}
+
+// DVIDCheck collects the results of reading slabs back from DVID after they are
+// POSTed.  It is safe for concurrent use.
+type DVIDCheck struct {
+	URL           string         `json:"url"`
+	NumSlabs      int            `json:"num_slabs"`
+	NumMismatched int            `json:"num_mismatched"`
+	Mismatches    []DVIDMismatch `json:"mismatches"`
+
+	mu sync.Mutex
+}
+
+// NewDVIDCheck returns an empty read-back report for a DVID data URL.
+func NewDVIDCheck(url string) *DVIDCheck {
+	return &DVIDCheck{URL: url, Mismatches: []DVIDMismatch{}}
+}
+
+func (c *DVIDCheck) add(m *DVIDMismatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.NumSlabs++
+	if m != nil {
+		c.NumMismatched++
+		c.Mismatches = append(c.Mismatches, *m)
+	}
+}
+
+// OK returns true if every slab read back matched.
+func (c *DVIDCheck) OK() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.NumMismatched == 0
+}
+
+// Summary returns a one-line description of the read-back.
+func (c *DVIDCheck) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("%d of %d slabs read back from %s differ", c.NumMismatched, c.NumSlabs, c.URL)
+}
+
+// WriteJSON writes the report as indented JSON with mismatches in slab order.
+func (c *DVIDCheck) WriteJSON(filename string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sort.Slice(c.Mismatches, func(i, j int) bool {
+		a, b := c.Mismatches[i].Origin, c.Mismatches[j].Origin
+		if a[2] != b[2] {
+			return a[2] < b[2]
+		}
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		return a[0] < b[0]
+	})
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// rawURL returns the URL of the raw endpoint for a slab's region.
+func (ds *DVIDSink) rawURL(slab Slab) string {
+	return fmt.Sprintf("%s/raw/0_1_2/%d_%d_%d/%d_%d_%d", ds.URL, slab.Size[0], slab.Size[1], slab.Size[2],
+		slab.Origin[0], slab.Origin[1], slab.Origin[2])
+}
+
+// readURL returns the URL to GET a slab's labels from DVID.  Supervoxel slabs are
+// read unmapped, since a labelmap otherwise returns the body of each supervoxel.
+func (ds *DVIDSink) readURL(slab Slab) string {
+	if ds.Supervoxels {
+		return ds.rawURL(slab) + "?supervoxels=true"
+	}
+	return ds.rawURL(slab)
+}
+
+// readBack GETs a slab's region from DVID, uncompressed, and records any difference
+// from the slab in the sink's check.  It returns an error if the slab differs or
+// couldn't be read, so the slab isn't recorded as written.
+func (ds *DVIDSink) readBack(slab Slab) error {
+	m := ds.check(slab)
+	switch {
+	case m == nil:
+		return nil
+	case m.Error != "":
+		return fmt.Errorf("Unable to read back slab from DVID: %s", m.Error)
+	default:
+		return fmt.Errorf("%d voxels read back from DVID differ from those sent, e.g., (%d,%d,%d) is %d instead of %d",
+			m.Voxels, m.First[0], m.First[1], m.First[2], m.Received, m.Sent)
+	}
+}
+
+// check GETs a slab's region from DVID and compares it with the slab.  Any difference
+// is recorded in the sink's check and returned.
+func (ds *DVIDSink) check(slab Slab) *DVIDMismatch {
+	url := ds.readURL(slab)
+	m := &DVIDMismatch{Origin: slab.Origin, Size: slab.Size, URL: url}
+
+	data, err := ds.Client.Do("GET", url, nil)
+	if err != nil {
+		m.Error = err.Error()
+	} else {
+		m = compareSlab(slab, data, m)
+	}
+	ds.Check.add(m)
+	return m
+}
+
+// compareSlab compares a slab with the labels read back for it.  It returns nil if
+// they are the same.
+func compareSlab(slab Slab, data []byte, m *DVIDMismatch) *DVIDMismatch {
+	if len(data) != len(slab.Data) {
+		m.Error = fmt.Sprintf("read back %d bytes, expected %d", len(data), len(slab.Data))
+		return m
+	}
+	nx, nxy := slab.Size[0], slab.Size[0]*slab.Size[1]
+	for i := 0; i < len(data); i += 8 {
+		sent := binary.LittleEndian.Uint64(slab.Data[i:])
+		received := binary.LittleEndian.Uint64(data[i:])
+		if sent == received {
+			continue
+		}
+		if m.Voxels == 0 {
+			v := i / 8
+			m.First = [3]int{slab.Origin[0] + v%nx, slab.Origin[1] + v%nxy/nx, slab.Origin[2] + v/nxy}
+			m.Sent, m.Received = sent, received
+		}
+		m.Voxels++
+	}
+	if m.Voxels == 0 {
+		return nil
+	}
+	return m
+}
+
+// AuditDVID reads back the region of each slab file in a directory from a DVID data
+// URL with the given client and compares it with the file.  Slabs whose sidecars say
+// they hold supervoxel ids are read back as supervoxels.
+func AuditDVID(client *DVIDClient, url, dir string) (*DVIDCheck, error) {
+	files, _, err := slabFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var origins [][3]int
+	for origin := range files {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		a, b := origins[i], origins[j]
+		if a[2] != b[2] {
+			return a[2] < b[2]
+		}
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		return a[0] < b[0]
+	})
+
+	ds := &DVIDSink{URL: url, Check: NewDVIDCheck(url), Client: client}
+	for _, origin := range origins {
+		sf, err := slabs.Read(files[origin])
+		if err != nil {
+			return nil, err
+		}
+		slab := Slab{
+			Data:   make([]byte, len(sf.Labels)*8),
+			Origin: sf.Metadata.Origin,
+			Size:   sf.Metadata.Size,
+		}
+		for i, label := range sf.Labels {
+			binary.LittleEndian.PutUint64(slab.Data[i*8:], label)
+		}
+		fmt.Printf("Reading back slab @ (%d,%d,%d) from %s\n", origin[0], origin[1], origin[2], url)
+		ds.Supervoxels = sf.Metadata.Supervoxels
+		ds.check(slab)
+	}
+	return ds.Check, nil
+}
+
+// dvidSinks returns the DVID sinks within a sink.
+func dvidSinks(s Sink) []*DVIDSink {
+	switch s := s.(type) {
+	case *DVIDSink:
+		return []*DVIDSink{s}
+	case MultiSink:
+		var sinks []*DVIDSink
+		for _, sub := range s {
+			sinks = append(sinks, dvidSinks(sub)...)
+		}
+		return sinks
+	default:
+		return nil
+	}
+}
+
+// writeDVIDChecks writes the read-back report of each verifying DVID sink and returns
+// an error if any slab differed.  The export usually stops at the first difference,
+// but slabs sent concurrently may add more.
+func (e *Exporter) writeDVIDChecks() error {
+	var err error
+	for _, ds := range dvidSinks(e.sink) {
+		if ds.Check == nil || ds.DryRun {
+			continue
+		}
+		filename := e.opts.stateFilename("dvid-verify-z%d-%d.json")
+		if werr := ds.Check.WriteJSON(filename); werr != nil {
+			return werr
+		}
+		fmt.Printf("%s\nWrote DVID read-back report to %s\n", ds.Check.Summary(), filename)
+		if !ds.Check.OK() && err == nil {
+			err = fmt.Errorf("slabs read back from DVID differ from those sent")
+		}
+	}
+	return err
+}
@@ -0,0 +1,284 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDVID is a stand-in for a DVID labels instance that stores uncompressed slabs
+// POSTed to its raw endpoint and returns them for GETs of the same region.  Like a
+// labelmap, GETs without supervoxels=true return the body of any label in bodies.
+type testDVID struct {
+	mu      sync.Mutex
+	volumes map[string][]byte // raw endpoint path -> labels
+	corrupt map[string]int    // raw endpoint path -> voxel changed in GET responses
+	bodies  map[uint64]uint64 // supervoxel -> body mappings
+}
+
+func newTestDVID(t *testing.T) (*testDVID, *httptest.Server) {
+	d := &testDVID{volumes: make(map[string][]byte), corrupt: make(map[string]int), bodies: make(map[uint64]uint64)}
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	return d, server
+}
+
+func (d *testDVID) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case "POST":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.volumes[r.URL.Path] = data
+	case "GET":
+		data, found := d.volumes[r.URL.Path]
+		if !found {
+			http.Error(w, "no data stored for "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		if v, found := d.corrupt[r.URL.Path]; found {
+			data = append([]byte{}, data...)
+			data[8*v]++
+		}
+		if r.URL.Query().Get("supervoxels") != "true" && len(d.bodies) != 0 {
+			data = append([]byte{}, data...)
+			for i := 0; i < len(data); i += 8 {
+				if body, found := d.bodies[binary.LittleEndian.Uint64(data[i:])]; found {
+					binary.LittleEndian.PutUint64(data[i:], body)
+				}
+			}
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// put stores a slab's labels for its raw endpoint URL as if they had been POSTed.
+func (d *testDVID) put(t *testing.T, rawURL string, slab Slab) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.volumes[urlPath(t, rawURL)] = slab.Data
+}
+
+// corruptVoxel makes GETs of a raw endpoint URL return a different label for a voxel.
+func (d *testDVID) corruptVoxel(t *testing.T, rawURL string, v int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.corrupt[urlPath(t, rawURL)] = v
+}
+
+func urlPath(t *testing.T, rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Path
+}
+
+// testSlab returns a slab whose labels vary with each voxel's position.
+func testSlab(origin, size [3]int) Slab {
+	slab := Slab{
+		Data:     make([]byte, 8*size[0]*size[1]*size[2]),
+		Origin:   origin,
+		Size:     size,
+		ValidMin: origin,
+		ValidMax: [3]int{origin[0] + size[0] - 1, origin[1] + size[1] - 1, origin[2] + size[2] - 1},
+	}
+	i := 0
+	for z := 0; z < size[2]; z++ {
+		for y := 0; y < size[1]; y++ {
+			for x := 0; x < size[0]; x++ {
+				label := uint64(origin[0]+x)/3 + uint64(origin[1]+y)*1000 + uint64(origin[2]+z)<<32
+				binary.LittleEndian.PutUint64(slab.Data[i:], label)
+				i += 8
+			}
+		}
+	}
+	return slab
+}
+
+func testDVIDClient() *DVIDClient {
+	return NewDVIDClient(5*time.Second, 0, 1)
+}
+
+// TestDVIDReadBack checks that a slab POSTed to DVID is accepted if it reads back the
+// same, and fails and is recorded if it differs or can't be read back.
+func TestDVIDReadBack(t *testing.T) {
+	d, server := newTestDVID(t)
+	url := server.URL + "/api/node/abc/seg"
+	ds := &DVIDSink{URL: url, Compression: "none", Check: NewDVIDCheck(url), Client: testDVIDClient()}
+	size := [3]int{8, 4, 2}
+
+	same := testSlab([3]int{0, 0, 0}, size)
+	if err := ds.WriteSlab(same); err != nil {
+		t.Fatalf("slab that reads back the same failed: %v", err)
+	}
+	if !ds.Check.OK() || ds.Check.NumSlabs != 1 {
+		t.Fatalf("expected 1 matching slab, got %s", ds.Check.Summary())
+	}
+
+	differ := testSlab([3]int{8, 4, 2}, size)
+	d.corruptVoxel(t, ds.rawURL(differ), 13)
+	err := ds.WriteSlab(differ)
+	if err == nil || !strings.Contains(err.Error(), "1 voxels read back from DVID differ") {
+		t.Fatalf("expected read-back of a changed slab to fail, got %v", err)
+	}
+	if ds.Check.OK() || ds.Check.NumMismatched != 1 {
+		t.Fatalf("expected 1 mismatched slab, got %s", ds.Check.Summary())
+	}
+	m := ds.Check.Mismatches[0]
+	sent := binary.LittleEndian.Uint64(differ.Data[8*13:])
+	if m.Origin != differ.Origin || m.Voxels != 1 || m.First != [3]int{8 + 5, 4 + 1, 2} ||
+		m.Sent != sent || m.Received != sent+1 || m.Error != "" {
+		t.Fatalf("unexpected mismatch recorded: %+v", m)
+	}
+
+	// A region DVID doesn't have, e.g., because the POST went elsewhere.
+	missing := testSlab([3]int{16, 0, 0}, size)
+	m2 := ds.check(missing)
+	if m2 == nil || !strings.Contains(m2.Error, "status 404") {
+		t.Fatalf("expected a 404 reading back a missing slab, got %+v", m2)
+	}
+	if ds.Check.NumSlabs != 3 || ds.Check.NumMismatched != 2 {
+		t.Fatalf("expected 2 of 3 slabs to differ, got %s", ds.Check.Summary())
+	}
+}
+
+// TestCompareSlab checks the differences found between a slab and labels read back.
+func TestCompareSlab(t *testing.T) {
+	slab := testSlab([3]int{100, 200, 300}, [3]int{4, 3, 2})
+	data := append([]byte{}, slab.Data...)
+	if m := compareSlab(slab, data, &DVIDMismatch{}); m != nil {
+		t.Fatalf("identical labels compared as different: %+v", m)
+	}
+
+	// Change voxels (1,2,0) and (3,0,1).
+	binary.LittleEndian.PutUint64(data[8*(1+2*4):], 7)
+	binary.LittleEndian.PutUint64(data[8*(3+12):], 9)
+	m := compareSlab(slab, data, &DVIDMismatch{})
+	if m == nil || m.Voxels != 2 || m.First != [3]int{101, 202, 300} || m.Received != 7 ||
+		m.Sent != binary.LittleEndian.Uint64(slab.Data[8*9:]) {
+		t.Fatalf("unexpected mismatch: %+v", m)
+	}
+
+	if m := compareSlab(slab, data[:16], &DVIDMismatch{}); m == nil || m.Error == "" {
+		t.Fatalf("short read back not reported: %+v", m)
+	}
+}
+
+// TestAuditDVID checks an audit of slab files against a stand-in DVID server that
+// has one slab the same, one changed, and one missing, and the report written.
+func TestAuditDVID(t *testing.T) {
+	d, server := newTestDVID(t)
+	url := server.URL + "/api/node/abc/seg"
+	dir := t.TempDir()
+	fs, err := NewFileSink(dir, "gzip", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Sidecars = true
+	size := [3]int{8, 4, 2}
+	ds := &DVIDSink{URL: url}
+	var written []Slab
+	for _, origin := range [][3]int{{8, 0, 2}, {0, 0, 2}, {0, 4, 0}} {
+		slab := testSlab(origin, size)
+		if err := fs.WriteSlab(slab); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, slab)
+	}
+	d.put(t, ds.rawURL(written[0]), written[0])
+	d.put(t, ds.rawURL(written[1]), written[1])
+	d.corruptVoxel(t, ds.rawURL(written[0]), 0)
+
+	check, err := AuditDVID(testDVIDClient(), url, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.NumSlabs != 3 || check.NumMismatched != 2 {
+		t.Fatalf("expected 2 of 3 slabs to differ, got %s", check.Summary())
+	}
+
+	filename := filepath.Join(dir, "audit.json")
+	if err := check.WriteJSON(filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		URL           string         `json:"url"`
+		NumSlabs      int            `json:"num_slabs"`
+		NumMismatched int            `json:"num_mismatched"`
+		Mismatches    []DVIDMismatch `json:"mismatches"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.URL != url || report.NumSlabs != 3 || report.NumMismatched != 2 || len(report.Mismatches) != 2 {
+		t.Fatalf("unexpected report:\n%s", data)
+	}
+	missing, changed := report.Mismatches[0], report.Mismatches[1]
+	if missing.Origin != [3]int{0, 4, 0} || !strings.Contains(missing.Error, "status 404") {
+		t.Errorf("expected missing slab @ (0,4,0) first in report, got %+v", missing)
+	}
+	if changed.Origin != [3]int{8, 0, 2} || changed.Voxels != 1 || changed.First != changed.Origin ||
+		changed.URL != ds.rawURL(written[0]) || changed.Received != changed.Sent+1 {
+		t.Errorf("unexpected report of changed slab: %+v", changed)
+	}
+}
+
+// TestDVIDReadBackSupervoxels checks that supervoxel slabs are read back from a
+// labelmap with mappings as supervoxels, both after POSTs and in audits.
+func TestDVIDReadBackSupervoxels(t *testing.T) {
+	d, server := newTestDVID(t)
+	url := server.URL + "/api/node/abc/seg"
+	slab := testSlab([3]int{0, 0, 0}, [3]int{8, 4, 2})
+	for i := 0; i < len(slab.Data); i += 8 {
+		d.bodies[binary.LittleEndian.Uint64(slab.Data[i:])] = 99
+	}
+
+	ds := &DVIDSink{URL: url, Compression: "none", Check: NewDVIDCheck(url), Client: testDVIDClient()}
+	if err := ds.WriteSlab(slab); err == nil {
+		t.Fatalf("expected read-back of mapped bodies to differ from the supervoxels sent")
+	}
+	ds = &DVIDSink{URL: url, Compression: "none", Check: NewDVIDCheck(url), Client: testDVIDClient(), Supervoxels: true}
+	if err := ds.WriteSlab(slab); err != nil {
+		t.Fatalf("supervoxel slab that reads back the same failed: %v", err)
+	}
+
+	for _, supervoxels := range []bool{false, true} {
+		dir := t.TempDir()
+		fs, err := NewFileSink(dir, "gzip", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.Sidecars = true
+		fs.Supervoxels = supervoxels
+		if err := fs.WriteSlab(slab); err != nil {
+			t.Fatal(err)
+		}
+		check, err := AuditDVID(testDVIDClient(), url, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.OK() != supervoxels {
+			t.Errorf("audit of slab with supervoxels=%t: %s", supervoxels, check.Summary())
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Size of the synthetic Raveler session, chosen so slabs don't divide the slices
+// evenly and the Z range doesn't start at a slab boundary.
+const (
+	testWidth  = 150
+	testHeight = 100
+	testMinZ   = 3
+	testMaxZ   = 21
+)
+
+// testLabel returns the superpixel id of a pixel in the synthetic session: patches
+// of a few pixels, with label 0 along a diagonal.
+func testLabel(x, y, z int) uint32 {
+	if (x+y+z)%41 == 0 {
+		return 0
+	}
+	return uint32(1 + (x/7+(y/5)*23+z)%400)
+}
+
+// writeTestSession writes superpixel images and text maps for the synthetic session
+// into dir and returns options that export it.  Slices alternate between 24-bit RGB
+// and 16-bit grayscale images, and every 37th superpixel is left unmapped.
+func writeTestSession(t testing.TB, dir string) Options {
+	spdir := filepath.Join(dir, "sp")
+	if err := os.Mkdir(spdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var sp2seg, seg2body bytes.Buffer
+	for z := testMinZ; z <= testMaxZ; z++ {
+		var img image.Image
+		if z%2 == 0 {
+			rgba := image.NewRGBA(image.Rect(0, 0, testWidth, testHeight))
+			for y := 0; y < testHeight; y++ {
+				for x := 0; x < testWidth; x++ {
+					id := testLabel(x, y, z)
+					rgba.Set(x, y, color.RGBA{uint8(id), uint8(id >> 8), uint8(id >> 16), 255})
+				}
+			}
+			img = rgba
+		} else {
+			gray := image.NewGray16(image.Rect(0, 0, testWidth, testHeight))
+			for y := 0; y < testHeight; y++ {
+				for x := 0; x < testWidth; x++ {
+					gray.SetGray16(x, y, color.Gray16{uint16(testLabel(x, y, z))})
+				}
+			}
+			img = gray
+		}
+		f, err := os.Create(filepath.Join(spdir, fmt.Sprintf("superpixel_map.%05d.png", z)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		for label := 1; label <= 400; label++ {
+			if label%37 == 0 {
+				continue
+			}
+			segment := z*1000 + label
+			fmt.Fprintf(&sp2seg, "%d %d %d\n", z, label, segment)
+			fmt.Fprintf(&seg2body, "%d %d\n", segment, 1+segment%53)
+		}
+	}
+	writeTestFile(t, filepath.Join(dir, "sp2seg.txt"), sp2seg.Bytes())
+	writeTestFile(t, filepath.Join(dir, "seg2body.txt"), seg2body.Bytes())
+
+	opts := DefaultOptions()
+	opts.SuperpixelToSegment = filepath.Join(dir, "sp2seg.txt")
+	opts.SegmentToBody = filepath.Join(dir, "seg2body.txt")
+	opts.SuperpixelDir = spdir
+	opts.StateDir = filepath.Join(dir, "state")
+	opts.SlabX, opts.SlabY, opts.SlabZ = 64, 32, 8
+	opts.ROIBlockSize = 8
+	return opts
+}
+
+func writeTestFile(t testing.TB, filename string, data []byte) {
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestROI writes an ROI of two ragged runs of blocks and returns its filename.
+func writeTestROI(t testing.TB, dir string) string {
+	var spans []Span
+	for bz := 0; bz <= testMaxZ/8; bz++ {
+		for by := 1; by < testHeight/8; by++ {
+			spans = append(spans, Span{bz, by, by % 3, 4 + by%5}, Span{bz, by, 10, 12 + bz})
+		}
+	}
+	data, err := json.Marshal(spans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "roi.json")
+	writeTestFile(t, filename, data)
+	return filename
+}
+
+// sequential returns the options with every stage of the pipeline using one worker.
+func sequential(opts Options) Options {
+	opts.DecodeWorkers = 1
+	opts.RelabelWorkers = 1
+	opts.WriteQueue = 0
+	opts.SlabWorkers = 1
+	return opts
+}
+
+// parallel returns the options with several workers at every stage of the pipeline.
+func parallel(opts Options, workers int) Options {
+	opts.DecodeWorkers = workers
+	opts.RelabelWorkers = workers
+	opts.WriteQueue = 2
+	opts.SlabWorkers = workers
+	return opts
+}
+
+// bandOptions returns the options with a memory limit that allows bands of only one
+// row of slabs.
+func bandOptions(t testing.TB, opts Options) Options {
+	table, err := opts.BodyTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	opts.MemLimit = 1
+	_, need, _ := opts.bandMemory(testWidth, testHeight, int64(table.Bytes()))
+	opts.MemLimit = need
+	if bandY, _, err := opts.bandMemory(testWidth, testHeight, int64(table.Bytes())); err != nil || bandY != opts.SlabY {
+		t.Fatalf("expected bands of %d rows, got %d rows: %v", opts.SlabY, bandY, err)
+	}
+	return opts
+}
+
+// exportSlabs runs an export into memory and returns the slabs sorted by origin.
+func exportSlabs(t testing.TB, opts Options) []Slab {
+	var sink MemorySink
+	e, err := NewWithSink(opts, &sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sortSlabs(sink.Slabs)
+	return sink.Slabs
+}
+
+func sortSlabs(slabs []Slab) {
+	sort.Slice(slabs, func(i, j int) bool {
+		a, b := slabs[i].Origin, slabs[j].Origin
+		if a[2] != b[2] {
+			return a[2] < b[2]
+		}
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		return a[0] < b[0]
+	})
+}
+
+// compareSlabs reports any difference between two exports.
+func compareSlabs(t *testing.T, name string, want, got []Slab) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d slabs, expected %d", name, len(got), len(want))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Origin != w.Origin || g.Size != w.Size || g.ValidMin != w.ValidMin || g.ValidMax != w.ValidMax {
+			t.Fatalf("%s: slab %d is %v+%v valid %v-%v, expected %v+%v valid %v-%v", name, i,
+				g.Size, g.Origin, g.ValidMin, g.ValidMax, w.Size, w.Origin, w.ValidMin, w.ValidMax)
+		}
+		if !bytes.Equal(g.Data, w.Data) {
+			t.Fatalf("%s: labels of slab @ %v differ", name, w.Origin)
+		}
+	}
+}
+
+// TestWorkersMatchSequential checks that the concurrent pipeline, memory-bounded
+// bands, and ROI masking all give the same slabs as a sequential export.
+func TestWorkersMatchSequential(t *testing.T) {
+	dir := t.TempDir()
+	base := writeTestSession(t, dir)
+	roiOpts := base
+	roiOpts.ROIFile = writeTestROI(t, dir)
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"full", base},
+		{"roi", roiOpts},
+	} {
+		want := exportSlabs(t, sequential(tc.opts))
+		if len(want) == 0 {
+			t.Fatalf("%s: sequential export wrote no slabs", tc.name)
+		}
+		for _, workers := range []int{2, 5} {
+			compareSlabs(t, fmt.Sprintf("%s, %d workers", tc.name, workers), want,
+				exportSlabs(t, parallel(tc.opts, workers)))
+		}
+		compareSlabs(t, tc.name+", bands", want, exportSlabs(t, bandOptions(t, sequential(tc.opts))))
+		compareSlabs(t, tc.name+", bands, 5 workers", want, exportSlabs(t, bandOptions(t, parallel(tc.opts, 5))))
+	}
+}
+
+// TestExportLabels checks the bodies of a sequential export against the synthetic
+// session, so TestWorkersMatchSequential isn't comparing equally wrong exports.
+func TestExportLabels(t *testing.T) {
+	opts := sequential(writeTestSession(t, t.TempDir()))
+	opts.BodyOffset = 1000
+	for _, slab := range exportSlabs(t, opts) {
+		labels := slabLabels(slab)
+		nx, ny := slab.Size[0], slab.Size[1]
+		for i, got := range labels {
+			x, y, z := slab.Origin[0]+i%nx, slab.Origin[1]+(i/nx)%ny, slab.Origin[2]+i/(nx*ny)
+			var want uint64
+			if x < testWidth && y < testHeight && z >= testMinZ && z <= testMaxZ {
+				if label := testLabel(x, y, z); label != 0 && label%37 != 0 {
+					want = 1000 + 1 + uint64(z*1000+int(label))%53
+				}
+			}
+			if got != want {
+				t.Fatalf("voxel (%d,%d,%d) is %d, expected %d", x, y, z, got, want)
+			}
+		}
+	}
+}
+
+// slabLabels returns the labels of a slab.
+func slabLabels(slab Slab) []uint64 {
+	labels := make([]uint64, len(slab.Data)/8)
+	for i := range labels {
+		d := slab.Data[8*i:]
+		labels[i] = uint64(d[0]) | uint64(d[1])<<8 | uint64(d[2])<<16 | uint64(d[3])<<24 |
+			uint64(d[4])<<32 | uint64(d[5])<<40 | uint64(d[6])<<48 | uint64(d[7])<<56
+	}
+	return labels
+}
@@ -0,0 +1,392 @@
+// Package exporter converts Raveler superpixel-based images + maps to a series of
+// optionally compressed label slabs that are written to files and/or POSTed to DVID.
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"time"
+
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// Options holds all settings for a Raveler export.  Use DefaultOptions() to get
+// the settings used by the raveler-exporter command.
+type Options struct {
+	// Raveler session inputs.
+	SuperpixelToSegment string // path to superpixel_to_segment_map.txt
+	SegmentToBody       string // path to segment_to_body_map.txt
+	SuperpixelDir       string // directory of superpixel PNG images
+
+	// Compiled superpixel->body map written by WriteCompiledMap.  If set, it is used
+	// instead of the two text maps.
+	BodyMap string
+
+	OutDir string // Output directory for file output
+	URL    string // POST URL for DVID, e.g., "http://dvidserver.com/api/653/dataname"
+
+	// Read each slab back from DVID after it is POSTed and compare it with the slab
+	// sent.  A slab that differs stops the export without being recorded as written,
+	// and differences are written to a report kept with the progress manifest.
+	DVIDVerify bool
+
+	// How slabs are sent to DVID: ProtocolRaw, or ProtocolBlocks for labelarray and
+	// labelmap instances, which sends compressed blocks of DVIDBlockSize^3 voxels.
+	// Slab dimensions must then be multiples of the block size.
+	DVIDProtocol  string
+	DVIDBlockSize int
+
+	// Each request to DVID times out after DVIDTimeout and is retried up to
+	// DVIDRetries times after network errors or server errors.  Requests throttled by
+	// a busy server are retried until DVIDThrottleWait has passed, or indefinitely if
+	// it is 0, like the original exporter.  If DVIDDeadline is positive, no retry of
+	// either kind starts after that long.
+	DVIDTimeout      time.Duration
+	DVIDRetries      int
+	DVIDThrottleWait time.Duration
+	DVIDDeadline     time.Duration
+
+	// Size of each label slab.
+	SlabX int
+	SlabY int
+	SlabZ int
+
+	ROIFile      string // Path to a ROI JSON containing sorted block index spans
+	ROIBlockSize int    // Size of each ROI block in pixels
+
+	BodyOffset int // Offset to apply to body labels.
+
+	// Write supervoxel ids, slice << 24 | superpixel, instead of bodies for every
+	// nonzero superpixel, and after the slabs, send the supervoxel->body mapping to
+	// the mappings endpoint of the DVID labelmap instance and write it to OutDir.
+	// Superpixels mapped to body 0 are still written as supervoxels, so a later
+	// mapping can give them a body, but have no mapping.  Until they are mapped, DVID
+	// treats each as a body of its own rather than as background, unlike a body
+	// export.  Unmapped superpixels are mapped to their unmapped body, so Unmapped
+	// can't be UnmappedZero.
+	Supervoxels bool
+
+	// How to label superpixels missing from the mapping: UnmappedZero, UnmappedFail,
+	// UnmappedSentinel, or UnmappedUnique.  UnmappedBody is the sentinel body or the
+	// base of the unique bodies.  BodyOffset isn't applied to these bodies.
+	Unmapped     string
+	UnmappedBody uint64
+
+	// Range of Z slices to process.
+	MinZ int
+	MaxZ int
+
+	Compression string // "lz4", "gzip", or "none"
+
+	// How to handle slab files that already exist in OutDir: OverwriteAlways,
+	// OverwriteSkip, or OverwriteFail.  Skipped slabs aren't recorded in the
+	// progress manifest.
+	Overwrite string
+
+	// Write a JSON slabs.Metadata sidecar next to each slab file in OutDir.
+	Sidecars bool
+
+	DryRun bool // Don't write files or send POST requests to DVID
+
+	// Each completed slab is recorded in a progress manifest kept in StateDir, or in
+	// OutDir if StateDir isn't set, or else in the current directory.  If Resume is
+	// set, slabs already recorded by an earlier run with the same settings and mapping
+	// are skipped.
+	StateDir string
+	Resume   bool
+
+	// Concurrency of the export pipeline.  Superpixel images are decoded by
+	// DecodeWorkers goroutines ahead of the slice being relabeled, each slice is
+	// relabeled by RelabelWorkers goroutines, and up to WriteQueue completed layers
+	// of SlabZ slices wait to be written while the next layer is filled.  Each queued
+	// layer needs another layer buffer in memory.  A WriteQueue of 0 writes each layer
+	// before starting the next.
+	DecodeWorkers  int
+	RelabelWorkers int
+	WriteQueue     int
+
+	// Number of slabs of a layer packed, compressed, and sent to the sink at once,
+	// limited further so the uncompressed slabs in flight take at most
+	// MaxInflightBytes if it is positive.  The sink must be safe for concurrent use
+	// if SlabWorkers > 1.
+	SlabWorkers      int
+	MaxInflightBytes int64
+
+	// If positive, limits memory use for slices too large to hold a layer of SlabZ
+	// slices in memory.  Superpixel images are then read one row at a time, and
+	// layers are relabeled and written in bands of slab rows that fit in MemLimit
+	// bytes together with the body table.  Bands use RelabelWorkers goroutines,
+	// one image each, and DecodeWorkers is ignored.
+	MemLimit int64
+}
+
+// DefaultOptions returns the default options for an export.
+func DefaultOptions() Options {
+	return Options{
+		SlabX:        512,
+		SlabY:        512,
+		SlabZ:        32,
+		ROIBlockSize: 32,
+		MinZ:         0,
+		MaxZ:         math.MaxInt32,
+		Compression:  "lz4",
+		Overwrite:    OverwriteAlways,
+		Sidecars:     true,
+		Unmapped:     UnmappedZero,
+
+		DecodeWorkers:  2,
+		RelabelWorkers: runtime.NumCPU(),
+		WriteQueue:     1,
+
+		SlabWorkers:      runtime.NumCPU(),
+		MaxInflightBytes: 1 << 30,
+
+		DVIDProtocol:     ProtocolRaw,
+		DVIDBlockSize:    64,
+		DVIDTimeout:      10 * time.Minute,
+		DVIDRetries:      8,
+		DVIDThrottleWait: 24 * time.Hour,
+	}
+}
+
+// Validate returns an error if the options can't be used for an export.
+func (opts Options) Validate() error {
+	if opts.SlabX < 1 || opts.SlabY < 1 {
+		return fmt.Errorf("Slab dimensions must be >= 1 pixel")
+	}
+	if opts.SlabZ < 1 {
+		return fmt.Errorf("Thickness must be >= 1 Z slice")
+	}
+	if opts.ROIBlockSize < 1 {
+		return fmt.Errorf("ROI block size must be >= 1 pixel")
+	}
+	switch opts.Compression {
+	case "none", "lz4", "gzip":
+	default:
+		return fmt.Errorf("unknown compression type %q", opts.Compression)
+	}
+	switch opts.Overwrite {
+	case OverwriteAlways, OverwriteSkip, OverwriteFail:
+	default:
+		return fmt.Errorf("unknown overwrite policy %q", opts.Overwrite)
+	}
+	if opts.DecodeWorkers < 1 || opts.RelabelWorkers < 1 {
+		return fmt.Errorf("Must have at least one decode and relabel worker")
+	}
+	if opts.SlabWorkers < 1 {
+		return fmt.Errorf("Must have at least one slab worker")
+	}
+	if opts.MemLimit < 0 {
+		return fmt.Errorf("Memory limit can't be negative")
+	}
+	switch opts.DVIDProtocol {
+	case ProtocolRaw:
+	case ProtocolBlocks:
+		bs := opts.DVIDBlockSize
+		if bs < subBlockSize || bs%subBlockSize != 0 {
+			return fmt.Errorf("DVID block size must be a positive multiple of %d", subBlockSize)
+		}
+		if opts.SlabX%bs != 0 || opts.SlabY%bs != 0 || opts.SlabZ%bs != 0 {
+			return fmt.Errorf("Slab dimensions %d x %d x %d must be multiples of the DVID block size (%d) for the blocks protocol; set -slabX, -slabY and -slabZ, e.g., -slabZ=%d",
+				opts.SlabX, opts.SlabY, opts.SlabZ, bs, bs)
+		}
+	default:
+		return fmt.Errorf("unknown DVID protocol %q", opts.DVIDProtocol)
+	}
+	if opts.DVIDTimeout < 0 || opts.DVIDRetries < 0 || opts.DVIDThrottleWait < 0 || opts.DVIDDeadline < 0 {
+		return fmt.Errorf("DVID timeout, retries, throttle wait and deadline can't be negative")
+	}
+	if opts.WriteQueue < 0 {
+		return fmt.Errorf("Write queue length can't be negative")
+	}
+	switch opts.Unmapped {
+	case UnmappedZero, UnmappedFail:
+	case UnmappedSentinel, UnmappedUnique:
+		if opts.UnmappedBody == 0 {
+			return fmt.Errorf("unmapped policy %q requires a non-zero unmapped body", opts.Unmapped)
+		}
+	default:
+		return fmt.Errorf("unknown unmapped superpixel policy %q", opts.Unmapped)
+	}
+	if opts.Supervoxels && opts.Unmapped == UnmappedZero {
+		return fmt.Errorf("supervoxels are never written as body 0, so unmapped superpixels need another unmapped policy when exporting supervoxels")
+	}
+	return nil
+}
+
+// ZHead returns the first Z of the slab in which this z is located.
+func (opts Options) ZHead(z int) int {
+	nz := z / opts.SlabZ
+	return opts.SlabZ * nz
+}
+
+// JobRange is the range of Z slices exported by one cluster job.
+type JobRange struct {
+	MinZ  int
+	MaxZ  int // last Z of the job's last slab
+	Files int // # of superpixel images in the range
+}
+
+// SplitJobs divides the Z slices of the superpixel images, given in processing order,
+// into cluster jobs of at least filesPerJob images.  Jobs end on slab boundaries so
+// no two jobs write the same slab.
+func (opts Options) SplitJobs(zs []int, filesPerJob int) []JobRange {
+	var jobs []JobRange
+	var cur JobRange
+	var zoffset int // the starting z of current slab
+	for i, z := range zs {
+		if i == 0 {
+			cur.MinZ = z
+		} else if opts.ZHead(z) != zoffset && cur.Files >= filesPerJob {
+			// Good stopping place given block sizes.
+			cur.MaxZ = zoffset + opts.SlabZ - 1
+			jobs = append(jobs, cur)
+			cur = JobRange{MinZ: z}
+		}
+		zoffset = opts.ZHead(z)
+		cur.Files++
+	}
+	if cur.Files > 0 {
+		cur.MaxZ = zoffset + opts.SlabZ - 1
+		jobs = append(jobs, cur)
+	}
+	return jobs
+}
+
+// Sink returns a sink for the DVID and/or file outputs given in the options.
+func (opts Options) Sink() (Sink, error) {
+	var sinks MultiSink
+	if opts.URL != "" {
+		ds := NewDVIDSink(opts.URL, opts.Compression, opts.DryRun)
+		ds.Client = opts.DVIDClient()
+		ds.Protocol = opts.DVIDProtocol
+		ds.BlockSize = opts.DVIDBlockSize
+		ds.Supervoxels = opts.Supervoxels
+		if opts.DVIDVerify {
+			ds.Check = NewDVIDCheck(opts.URL)
+		}
+		sinks = append(sinks, ds)
+	}
+	if opts.OutDir != "" {
+		fs, err := NewFileSink(opts.OutDir, opts.Compression, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		fs.Overwrite = opts.Overwrite
+		fs.Sidecars = opts.Sidecars
+		fs.BodyOffset = opts.BodyOffset
+		fs.Supervoxels = opts.Supervoxels
+		fs.Session = slabs.Session{
+			SuperpixelToSegment: opts.SuperpixelToSegment,
+			SegmentToBody:       opts.SegmentToBody,
+			BodyMap:             opts.BodyMap,
+			SuperpixelDir:       opts.SuperpixelDir,
+		}
+		sinks = append(sinks, fs)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("Must either use -url and/or -outdir for output!")
+	case 1:
+		return sinks[0], nil
+	default:
+		return sinks, nil
+	}
+}
+
+// DVIDClient returns a client for DVID requests with the timeout and retries given in
+// the options.
+func (opts Options) DVIDClient() *DVIDClient {
+	client := NewDVIDClient(opts.DVIDTimeout, opts.DVIDRetries, opts.SlabWorkers)
+	client.ThrottleWait = opts.DVIDThrottleWait
+	client.Deadline = opts.DVIDDeadline
+	return client
+}
+
+// BodyTable returns the superpixel->body table for slices in the Z range, either from
+// the compiled map or the two text maps given in the options.  The table should be
+// closed after use.
+func (opts Options) BodyTable() (*BodyTable, error) {
+	if opts.BodyMap != "" {
+		return OpenCompiledMap(opts.BodyMap)
+	}
+	return LoadBodyTable(opts.SuperpixelToSegment, opts.SegmentToBody, opts.MinZ, opts.MaxZ)
+}
+
+// pngSource returns a source for the superpixel directory given in the options.
+func (opts Options) pngSource() Source {
+	src := NewPNGDirSource(opts.SuperpixelDir)
+	src.Workers = opts.DecodeWorkers
+	return src
+}
+
+// Exporter runs a Raveler export for a given set of options.  Separate Exporter values
+// can be run with different options in the same process.
+type Exporter struct {
+	opts     Options
+	sink     Sink
+	source   Source
+	manifest *Manifest // progress of the current run, nil for dry runs
+}
+
+// New returns an Exporter that writes to the outputs given in the options, or an
+// error if the options are invalid.
+func New(opts Options) (*Exporter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	sink, err := opts.Sink()
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{opts: opts, sink: sink, source: opts.pngSource()}, nil
+}
+
+// NewWithSink returns an Exporter that sends all slabs to the given sink.  The
+// OutDir and URL options are ignored.
+func NewWithSink(opts Options, sink Sink) (*Exporter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if sink == nil {
+		return nil, fmt.Errorf("no sink given for export")
+	}
+	return &Exporter{opts: opts, sink: sink, source: opts.pngSource()}, nil
+}
+
+// SetSource replaces the superpixel directory given in the options with another
+// source of superpixel planes.
+func (e *Exporter) SetSource(src Source) {
+	e.source = src
+}
+
+// Options returns the options for this exporter.
+func (e *Exporter) Options() Options {
+	return e.opts
+}
+
+// Run loads the Raveler maps, transforms each superpixel plane in the Z range into
+// body labels, and writes the label slabs to the configured outputs.
+func (e *Exporter) Run() error {
+	return e.processRavelerExport()
+}
+
+// TimeLog adds elapsed time to logging.
+// Example:
+//
+//	mylog := NewTimeLog()
+//	...
+//	mylog.Printf("stuff happened")  // Appends elapsed time from NewTimeLog() to message.
+type TimeLog struct {
+	start time.Time
+}
+
+func NewTimeLog() TimeLog {
+	return TimeLog{time.Now()}
+}
+
+func (t TimeLog) Printf(format string, args ...interface{}) {
+	log.Printf(format+": %s\n", append(args, time.Since(t.start))...)
+}
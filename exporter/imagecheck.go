@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+)
+
+// SliceCheck is the cross-check of one superpixel image against the mapping.
+type SliceCheck struct {
+	Z              int      `json:"z"`
+	Image          string   `json:"image"`
+	NumSuperpixels int      `json:"num_superpixels"`   // distinct non-zero superpixel ids in the image
+	Missing        []uint32 `json:"missing,omitempty"` // ids in the image without a mapping
+	Unused         []uint32 `json:"unused,omitempty"`  // mapped ids that don't appear in the image
+}
+
+// ImageCheck is a machine-readable report of superpixel images checked against a
+// superpixel->body mapping.
+type ImageCheck struct {
+	MinZ int `json:"minz"`
+	MaxZ int `json:"maxz"`
+
+	NumImages  int `json:"num_images"`
+	NumMissing int `json:"num_missing"` // total ids in images without a mapping
+	NumUnused  int `json:"num_unused"`  // total mapped ids not in any image
+
+	// Mapped slices in the Z range that have no superpixel image.
+	SlicesWithoutImages []uint32 `json:"slices_without_images,omitempty"`
+
+	Slices []SliceCheck `json:"slices"`
+}
+
+// OK returns true if every superpixel in the images is mapped.  Unused mappings don't
+// affect the export and are only reported.
+func (c *ImageCheck) OK() bool {
+	return c.NumMissing == 0
+}
+
+// Summary returns a one-line description of the check.
+func (c *ImageCheck) Summary() string {
+	return fmt.Sprintf("%d superpixel images: %d superpixel ids without mapping, %d mappings unused, %d mapped slices without image",
+		c.NumImages, c.NumMissing, c.NumUnused, len(c.SlicesWithoutImages))
+}
+
+// WriteJSON writes the report as indented JSON to a file.
+func (c *ImageCheck) WriteJSON(filename string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// idSet is a set of 24-bit superpixel ids.
+type idSet []uint64
+
+func newIDSet() idSet {
+	return make(idSet, (1<<24)/64)
+}
+
+func (s idSet) add(id uint32) {
+	s[id>>6] |= 1 << (id & 63)
+}
+
+func (s idSet) has(id uint32) bool {
+	return s[id>>6]&(1<<(id&63)) != 0
+}
+
+func (s idSet) clear() {
+	for i := range s {
+		s[i] = 0
+	}
+}
+
+// ids returns the ids in the set in increasing order.
+func (s idSet) ids() []uint32 {
+	var ids []uint32
+	for i, word := range s {
+		for word != 0 {
+			b := bits.TrailingZeros64(word)
+			ids = append(ids, uint32(i*64+b))
+			word &= word - 1
+		}
+	}
+	return ids
+}
+
+// CheckImages decodes each superpixel plane in the Z range once and compares its
+// distinct superpixel ids with the mapping for that slice, reporting ids missing
+// from the mapping and mapped ids that never appear in an image.
+func CheckImages(src Source, sp2body *BodyTable, minz, maxz int) (*ImageCheck, error) {
+	c := &ImageCheck{MinZ: minz, MaxZ: maxz, Slices: []SliceCheck{}}
+	seen := newIDSet()
+	checked := make(map[uint32]bool)
+	err := src.Walk(minz, maxz, func(plane Plane) error {
+		tlog := NewTimeLog()
+
+		img := plane.Image
+		b := img.Bounds()
+		seen.clear()
+		ids := make([]uint32, b.Dx())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			if err := superpixelRow(img, plane.Format, y, b.Min.X, b.Max.X, ids); err != nil {
+				return err
+			}
+			for _, label := range ids {
+				if label != 0 {
+					seen.add(label)
+				}
+			}
+		}
+
+		slice := sp2body.Slice(uint32(plane.Z))
+		sc := SliceCheck{Z: plane.Z, Image: plane.Name}
+		for _, label := range seen.ids() {
+			sc.NumSuperpixels++
+			if _, found := slice.Body(label); !found {
+				sc.Missing = append(sc.Missing, label)
+			}
+		}
+		for _, label := range slice.Labels() {
+			if label > 0xFFFFFF || !seen.has(label) {
+				sc.Unused = append(sc.Unused, label)
+			}
+		}
+		checked[uint32(plane.Z)] = true
+		c.NumImages++
+		c.NumMissing += len(sc.Missing)
+		c.NumUnused += len(sc.Unused)
+		c.Slices = append(c.Slices, sc)
+
+		tlog.Printf("Checked superpixel image %s: %d superpixels, %d unmapped, %d mappings unused",
+			plane.Name, sc.NumSuperpixels, len(sc.Missing), len(sc.Unused))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, z := range sp2body.Zs() {
+		if int64(z) < int64(minz) || int64(z) > int64(maxz) || checked[z] {
+			continue
+		}
+		c.SlicesWithoutImages = append(c.SlicesWithoutImages, z)
+		c.NumUnused += sp2body.Slice(z).NumLabels()
+	}
+	return c, nil
+}
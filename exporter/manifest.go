@@ -0,0 +1,296 @@
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ManifestVersion is the version of the progress manifest format.
+const ManifestVersion = 1
+
+// ManifestHeader is the first line of a progress manifest.  It records the options
+// that determine the slabs of an export, so a resumed export can't mix slabs from
+// different settings.
+type ManifestHeader struct {
+	Version      int    `json:"version"`
+	MinZ         int    `json:"minz"`
+	MaxZ         int    `json:"maxz"`
+	SlabSize     [3]int `json:"slab_size"`
+	Compression  string `json:"compression"`
+	BodyOffset   int    `json:"body_offset"`
+	Supervoxels  bool   `json:"supervoxels,omitempty"`
+	Unmapped     string `json:"unmapped"`
+	UnmappedBody uint64 `json:"unmapped_body,omitempty"`
+	ROIFile      string `json:"roi,omitempty"`
+	OutDir       string `json:"outdir,omitempty"`
+	URL          string `json:"url,omitempty"`
+
+	// The superpixel->body mapping: the text maps or compiled map it was read from
+	// and a CRC-32C of its contents.
+	SuperpixelToSegment string `json:"superpixel_to_segment,omitempty"`
+	SegmentToBody       string `json:"segment_to_body,omitempty"`
+	BodyMap             string `json:"bodymap,omitempty"`
+	MapChecksum         string `json:"map_crc32c"`
+}
+
+// ManifestEntry records a slab that was completely written to all outputs.  Bytes
+// and Checksum are the size and CRC-32C of the uncompressed slab data.
+type ManifestEntry struct {
+	Origin   [3]int `json:"origin"`
+	Size     [3]int `json:"size"`
+	Bytes    int    `json:"bytes"`
+	Checksum string `json:"crc32c"`
+}
+
+// Manifest is the persistent progress of an export: a JSON header line followed by
+// one JSON line per completed slab, appended as each slab is written.  Slabs in the
+// manifest are skipped when an export is resumed.
+type Manifest struct {
+	Header  ManifestHeader
+	Entries []ManifestEntry
+
+	filename string
+	file     *os.File
+	done     map[[3]int]bool
+
+	mu sync.Mutex
+}
+
+// manifestHeader returns the manifest header for the options.
+func (opts Options) manifestHeader() (ManifestHeader, error) {
+	header := ManifestHeader{
+		Version:      ManifestVersion,
+		MinZ:         opts.MinZ,
+		MaxZ:         opts.MaxZ,
+		SlabSize:     [3]int{opts.SlabX, opts.SlabY, opts.SlabZ},
+		Compression:  opts.Compression,
+		BodyOffset:   opts.BodyOffset,
+		Supervoxels:  opts.Supervoxels,
+		Unmapped:     opts.Unmapped,
+		UnmappedBody: opts.UnmappedBody,
+		ROIFile:      opts.ROIFile,
+		OutDir:       opts.OutDir,
+		URL:          opts.URL,
+	}
+	var err error
+	if opts.BodyMap != "" {
+		header.BodyMap = opts.BodyMap
+		header.MapChecksum, err = CompiledMapChecksum(opts.BodyMap)
+	} else {
+		header.SuperpixelToSegment = opts.SuperpixelToSegment
+		header.SegmentToBody = opts.SegmentToBody
+		header.MapChecksum, err = fileChecksum(opts.SuperpixelToSegment, opts.SegmentToBody)
+	}
+	if err != nil {
+		return header, fmt.Errorf("Unable to checksum superpixel->body mapping: %s", err.Error())
+	}
+	return header, nil
+}
+
+// fileChecksum returns the CRC-32C of the concatenated contents of files.
+func fileChecksum(filenames ...string) (string, error) {
+	crc := crc32.New(crc32c)
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(crc, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%08x", crc.Sum32()), nil
+}
+
+// stateFilename returns the path of a per-job state file: StateDir, or else OutDir,
+// or else the current directory, joined with the name for the job's Z range, so
+// cluster jobs sharing a directory use separate files.
+func (opts Options) stateFilename(format string) string {
+	dir := opts.StateDir
+	if dir == "" {
+		dir = opts.OutDir
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return filepath.Join(dir, fmt.Sprintf(format, opts.MinZ, opts.MaxZ))
+}
+
+// ManifestFilename returns the path of the progress manifest for the options.
+func (opts Options) ManifestFilename() string {
+	return opts.stateFilename("export-manifest-z%d-%d.jsonl")
+}
+
+// LoadManifest reads a progress manifest.  A truncated last line, left by a job that
+// was killed while appending it, is ignored.
+func LoadManifest(filename string) (*Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &Manifest{filename: filename, done: make(map[[3]int]bool)}
+	scanner := bufio.NewScanner(f)
+	var lineNum int
+	var bad error
+	for scanner.Scan() {
+		lineNum++
+		if bad != nil {
+			return nil, bad
+		}
+		line := scanner.Bytes()
+		if lineNum == 1 {
+			if err := json.Unmarshal(line, &m.Header); err != nil {
+				return nil, fmt.Errorf("Bad header in manifest %q: %s", filename, err.Error())
+			}
+			if m.Header.Version != ManifestVersion {
+				return nil, fmt.Errorf("Manifest %q has version %d, expected %d", filename, m.Header.Version, ManifestVersion)
+			}
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			bad = fmt.Errorf("Bad entry at line %d of manifest %q: %s", lineNum, filename, err.Error())
+			continue
+		}
+		m.add(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNum == 0 {
+		return nil, fmt.Errorf("Manifest %q is empty", filename)
+	}
+	return m, nil
+}
+
+func (m *Manifest) add(entry ManifestEntry) {
+	if !m.done[entry.Origin] {
+		m.Entries = append(m.Entries, entry)
+	}
+	m.done[entry.Origin] = true
+}
+
+// openManifest starts the progress manifest for an export.  If Resume is set and a
+// manifest for the same settings and mapping exists, its completed slabs are kept.  Otherwise
+// any existing manifest is replaced.  The manifest is rewritten through a temporary
+// file so a partial last entry is dropped before new entries are appended.
+func openManifest(opts Options) (*Manifest, error) {
+	filename := opts.ManifestFilename()
+	header, err := opts.manifestHeader()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Header: header, filename: filename, done: make(map[[3]int]bool)}
+
+	if opts.StateDir != "" {
+		if err := os.MkdirAll(opts.StateDir, 0755); err != nil {
+			return nil, fmt.Errorf("Can't make state directory: %s", err.Error())
+		}
+	}
+	if opts.Resume {
+		old, err := LoadManifest(filename)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("No manifest at %s, so exporting all slabs\n", filename)
+		case err != nil:
+			return nil, err
+		case old.Header != header:
+			return nil, fmt.Errorf("Can't resume: manifest %q was written with different options or mapping", filename)
+		default:
+			for _, entry := range old.Entries {
+				m.add(entry)
+			}
+			fmt.Printf("Resuming export with %d slabs already written according to %s\n", len(m.Entries), filename)
+		}
+	}
+
+	tmpname := filename + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create manifest: %s", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, entry := range m.Entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		return nil, err
+	}
+
+	if m.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Done returns true if the slab at the given origin has been written.
+func (m *Manifest) Done(origin [3]int) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done[origin]
+}
+
+// record appends a written slab to the manifest.  Each entry is a single write, so
+// a killed job leaves at most a truncated last line.
+func (m *Manifest) record(slab Slab) error {
+	if m == nil {
+		return nil
+	}
+	entry := ManifestEntry{
+		Origin:   slab.Origin,
+		Size:     slab.Size,
+		Bytes:    len(slab.Data),
+		Checksum: fmt.Sprintf("%08x", crc32.Checksum(slab.Data, crc32c)),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Unable to update manifest %q: %s", m.filename, err.Error())
+	}
+	m.add(entry)
+	return nil
+}
+
+// Close closes the manifest file.
+func (m *Manifest) Close() error {
+	if m == nil || m.file == nil {
+		return nil
+	}
+	return m.file.Close()
+}
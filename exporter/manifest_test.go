@@ -0,0 +1,141 @@
+package exporter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// failingSink keeps slabs in memory and fails every slab after the first n.
+type failingSink struct {
+	mu    sync.Mutex
+	n     int
+	slabs []Slab
+}
+
+func (fs *failingSink) WriteSlab(slab Slab) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.slabs) >= fs.n {
+		return fmt.Errorf("sink failed after %d slabs", fs.n)
+	}
+	data := make([]byte, len(slab.Data))
+	copy(data, slab.Data)
+	slab.Data = data
+	fs.slabs = append(fs.slabs, slab)
+	return nil
+}
+
+// TestResume checks that resuming an export that failed partway writes only the slabs
+// missing from its manifest, and that together the two runs write every slab once.
+func TestResume(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		opts := parallel(writeTestSession(t, t.TempDir()), workers)
+		want := exportSlabs(t, opts)
+
+		const n = 7
+		first := &failingSink{n: n}
+		e, err := NewWithSink(opts, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Run(); err == nil {
+			t.Fatalf("export to failing sink succeeded")
+		}
+		m, err := LoadManifest(opts.ManifestFilename())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Entries) != n {
+			t.Fatalf("%d workers: manifest has %d slabs after %d were written", workers, len(m.Entries), n)
+		}
+
+		// A job killed while appending to the manifest leaves a partial last line.
+		f, err := os.OpenFile(opts.ManifestFilename(), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"origin":[64,`)
+		f.Close()
+
+		opts.Resume = true
+		second := exportSlabs(t, opts)
+		if len(second) != len(want)-n {
+			t.Fatalf("%d workers: resumed export wrote %d slabs, expected %d", workers, len(second), len(want)-n)
+		}
+		got := append(first.slabs, second...)
+		sortSlabs(got)
+		compareSlabs(t, fmt.Sprintf("%d workers, resumed", workers), want, got)
+
+		if m, err = LoadManifest(opts.ManifestFilename()); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Entries) != len(want) {
+			t.Errorf("%d workers: manifest has %d slabs after resuming, expected %d", workers, len(m.Entries), len(want))
+		}
+		for i, slab := range want {
+			if !m.Done(slab.Origin) {
+				t.Errorf("%d workers: slab %d @ %v not in manifest", workers, i, slab.Origin)
+			}
+		}
+	}
+}
+
+// TestResumeMismatch checks that an export can't resume from a manifest written with
+// different options or a different mapping.
+func TestResumeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	base := sequential(writeTestSession(t, dir))
+	base.Resume = true
+
+	offset := base
+	offset.BodyOffset = 1000
+	unmapped := base
+	unmapped.Unmapped = UnmappedSentinel
+	unmapped.UnmappedBody = 7
+	slabSize := base
+	slabSize.SlabX = 32
+
+	for _, tc := range []struct {
+		name   string
+		opts   Options
+		change func()
+	}{
+		{"body offset", offset, nil},
+		{"unmapped policy", unmapped, nil},
+		{"slab size", slabSize, nil},
+		{"segment->body map", base, func() {
+			f, err := os.OpenFile(base.SegmentToBody, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(f, "%d %d\n", 999999, 1)
+			f.Close()
+		}},
+	} {
+		// Start from a complete manifest for the base options.
+		os.RemoveAll(filepath.Join(dir, "state"))
+		exportSlabs(t, base)
+
+		if tc.change != nil {
+			tc.change()
+		}
+		e, err := NewWithSink(tc.opts, &MemorySink{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Run(); err == nil || !strings.Contains(err.Error(), "Can't resume") {
+			t.Errorf("%s: expected resume to fail, got %v", tc.name, err)
+		}
+	}
+
+	// The same options and mapping resume with nothing left to write.
+	os.RemoveAll(filepath.Join(dir, "state"))
+	exportSlabs(t, base)
+	if got := exportSlabs(t, base); len(got) != 0 {
+		t.Errorf("resume of a complete export wrote %d slabs", len(got))
+	}
+}
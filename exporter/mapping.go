@@ -0,0 +1,297 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LoadBodyTable reads the Raveler superpixel->segment and segment->body maps and
+// returns the superpixel->body table for slices minz <= Z <= maxz.  Lines for other
+// slices are skipped, and if a current slice index (see BuildSliceIndex) exists for
+// the superpixel->segment map, only the parts of the file holding the needed slices
+// are read.  Either map may be gzip compressed.
+func LoadBodyTable(sp_to_seg, seg_to_body string, minz, maxz int) (*BodyTable, error) {
+	// Get the seg->body map
+	seg2body, err := loadSegBodyMap(seg_to_body)
+	if err != nil {
+		return nil, err
+	}
+
+	tlog := NewTimeLog()
+
+	builder := NewBodyTableBuilder()
+	var loaded int
+
+	// Get the sp->seg map and compute the sp->body mapping.
+	err = scanSuperpixelMap(sp_to_seg, minz, maxz, func(mr *MapReader, slice, superpixel, segment uint64) error {
+		if superpixel == 0 {
+			return nil
+		}
+		if superpixel > 0x0000000000FFFFFF {
+			return mr.FieldErrorf(1, "superpixel id %d exceeds 24-bit value", superpixel)
+		}
+		body, found := seg2body[segment]
+		if !found {
+			return mr.FieldErrorf(2, "segment %d not found in %s", segment, seg_to_body)
+		}
+
+		// Store this mapping.
+		builder.Add(Superpixel{uint32(slice), uint32(superpixel)}, body)
+
+		loaded++
+		if loaded%1000000 == 0 {
+			fmt.Printf("Loaded %d superpixel->body mappings\n", loaded)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the seg->body map.
+	seg2body = nil
+
+	sp2body := builder.Build()
+	tlog.Printf("Completed loading superpixel to body mappings")
+	fmt.Printf("Loaded %s\n", sp2body.MemoryReport())
+	return sp2body, nil
+}
+
+// scanSuperpixelMap calls fn for each line of a superpixel->segment map with a slice
+// in minz <= Z <= maxz, using the map's slice index if it is current.
+func scanSuperpixelMap(sp_to_seg string, minz, maxz int, fn func(mr *MapReader, slice, superpixel, segment uint64) error) error {
+	mr, err := OpenMapFile(sp_to_seg, 3)
+	if err != nil {
+		return fmt.Errorf("Could not open superpixel->segment map: %s", sp_to_seg)
+	}
+	defer mr.Close()
+
+	scanLines := func(mr *MapReader) error {
+		var vals [3]uint64
+		for {
+			err := mr.Next(vals[:])
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			slice := vals[0]
+			if slice > 0xFFFFFFFF {
+				return mr.FieldErrorf(0, "slice %d exceeds 32-bit value", slice)
+			}
+			if int64(slice) < int64(minz) || int64(slice) > int64(maxz) {
+				continue
+			}
+			if err := fn(mr, slice, vals[1], vals[2]); err != nil {
+				return err
+			}
+		}
+	}
+
+	var runs []sliceRun
+	if !mr.Compressed() {
+		if runs, err = readSliceIndex(sp_to_seg); err != nil {
+			return err
+		}
+	}
+	if runs == nil {
+		fmt.Printf("Processing superpixel->segment map: %s\n", sp_to_seg)
+		return scanLines(mr)
+	}
+	fmt.Printf("Processing superpixel->segment map for Z %d to %d using slice index: %s\n", minz, maxz, sp_to_seg)
+	file, err := os.Open(sp_to_seg)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, run := range runs {
+		if int64(run.slice) < int64(minz) || int64(run.slice) > int64(maxz) {
+			continue
+		}
+		if _, err := file.Seek(run.offset, io.SeekStart); err != nil {
+			return err
+		}
+		runReader := NewMapReader(io.LimitReader(file, run.length), sp_to_seg, 3)
+		runReader.setPosition(run.line, run.offset)
+		if err := scanLines(runReader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadSegBodyMap(filename string) (map[uint64]uint64, error) {
+	tlog := NewTimeLog()
+
+	segmentToBodyMap := make(map[uint64]uint64, 100000)
+	mr, err := OpenMapFile(filename, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open segment->body map: %s", filename)
+	}
+	defer mr.Close()
+	var vals [2]uint64
+	var loaded int
+	for {
+		err := mr.Next(vals[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		segmentToBodyMap[vals[0]] = vals[1]
+		loaded++
+
+		if loaded%100000 == 0 {
+			fmt.Printf("Loaded %d lines of segment->body map\n", loaded)
+		}
+	}
+	tlog.Printf("Loaded segment->body map, %s", filename)
+	return segmentToBodyMap, nil
+}
+
+// A slice index is a sidecar text file next to a superpixel->segment map that gives
+// the byte range and first line number of each run of lines for a slice, so jobs that
+// process a subset of slices can seek directly to them.  The index records the size
+// and modification time of the map and is ignored if the map has changed.
+//
+//	# raveler-exporter slice index v2
+//	# size 123456789 modtime 1436894421000000000
+//	<slice> <byte offset> <byte length> <line number>
+//	...
+const sliceIndexHeader = "# raveler-exporter slice index v2"
+
+// SliceIndexPath returns the path of the slice index for a superpixel->segment map.
+func SliceIndexPath(sp_to_seg string) string {
+	return sp_to_seg + ".sliceidx"
+}
+
+type sliceRun struct {
+	slice  uint32
+	offset int64
+	length int64
+	line   int
+}
+
+// BuildSliceIndex scans a superpixel->segment map and writes its slice index.
+// Compressed maps can't be indexed.
+func BuildSliceIndex(sp_to_seg string) error {
+	tlog := NewTimeLog()
+
+	mr, err := OpenMapFile(sp_to_seg, 3)
+	if err != nil {
+		return fmt.Errorf("Could not open superpixel->segment map: %s", sp_to_seg)
+	}
+	defer mr.Close()
+	if mr.Compressed() {
+		return fmt.Errorf("Can't build slice index for compressed map %s", sp_to_seg)
+	}
+	fileinfo, err := os.Stat(sp_to_seg)
+	if err != nil {
+		return err
+	}
+
+	var runs []sliceRun
+	var cur *sliceRun
+	var vals [3]uint64
+	for {
+		err := mr.Next(vals[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if vals[0] > 0xFFFFFFFF {
+			return mr.FieldErrorf(0, "slice %d exceeds 32-bit value", vals[0])
+		}
+		if cur == nil || cur.slice != uint32(vals[0]) {
+			runs = append(runs, sliceRun{slice: uint32(vals[0]), offset: mr.LineOffset(), line: mr.Line()})
+			cur = &runs[len(runs)-1]
+		}
+		cur.length = mr.Offset() - cur.offset
+	}
+
+	idxname := SliceIndexPath(sp_to_seg)
+	out, err := os.Create(idxname)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%s\n# size %d modtime %d\n", sliceIndexHeader, fileinfo.Size(), fileinfo.ModTime().UnixNano())
+	for _, run := range runs {
+		fmt.Fprintf(w, "%d %d %d %d\n", run.slice, run.offset, run.length, run.line)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	tlog.Printf("Wrote slice index with %d runs, %s", len(runs), idxname)
+	return nil
+}
+
+// readSliceIndex returns the runs of the slice index for the given map, or nil if
+// there is no index or it is out of date.
+func readSliceIndex(sp_to_seg string) ([]sliceRun, error) {
+	idxname := SliceIndexPath(sp_to_seg)
+	file, err := os.Open(idxname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileinfo, err := os.Stat(sp_to_seg)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []sliceRun
+	scanner := bufio.NewScanner(file)
+	linenum := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		linenum++
+		switch linenum {
+		case 1:
+			if line != sliceIndexHeader {
+				fmt.Printf("Ignoring slice index with unknown format: %s\n", idxname)
+				return nil, nil
+			}
+			continue
+		case 2:
+			var size, modtime int64
+			if _, err := fmt.Sscanf(line, "# size %d modtime %d", &size, &modtime); err != nil {
+				return nil, fmt.Errorf("Bad header in slice index %s: %s", idxname, err.Error())
+			}
+			if size != fileinfo.Size() || modtime != fileinfo.ModTime().UnixNano() {
+				fmt.Printf("Ignoring out-of-date slice index: %s\n", idxname)
+				return nil, nil
+			}
+			continue
+		}
+		var run sliceRun
+		if _, err := fmt.Sscanf(line, "%d %d %d %d", &run.slice, &run.offset, &run.length, &run.line); err != nil {
+			return nil, fmt.Errorf("Error in line %d of slice index %s", linenum, idxname)
+		}
+		runs = append(runs, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if linenum < 2 {
+		return nil, fmt.Errorf("Incomplete slice index %s", idxname)
+	}
+	if runs == nil {
+		runs = []sliceRun{}
+	}
+	return runs, nil
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSp2Seg has slice 4 in two runs of lines.  Each segment maps to 10 times itself.
+const testSp2Seg = `# superpixel->segment
+3 1 31
+4 1 41
+4 2 42
+5 1 51
+4 3 43
+6 1 61
+6 2 62
+7 1 71
+`
+
+func writeTestMaps(t *testing.T, dir string) (sp2seg, seg2body string) {
+	sp2seg = filepath.Join(dir, "sp2seg.txt")
+	seg2body = filepath.Join(dir, "seg2body.txt")
+	writeTestFile(t, sp2seg, []byte(testSp2Seg))
+	writeTestFile(t, seg2body, []byte("31 310\n41 410\n42 420\n43 430\n51 510\n61 610\n62 620\n71 710\n"))
+	return sp2seg, seg2body
+}
+
+// TestLoadBodyTableRange checks that only slices in the Z range are loaded, with or
+// without a slice index, and that an out-of-date index is ignored.
+func TestLoadBodyTableRange(t *testing.T) {
+	sp2seg, seg2body := writeTestMaps(t, t.TempDir())
+	want := map[Superpixel]uint64{
+		{4, 1}: 410, {4, 2}: 420, {4, 3}: 430, {5, 1}: 510, {6, 1}: 610, {6, 2}: 620,
+	}
+	check := func(name string) {
+		t.Helper()
+		table, err := LoadBodyTable(sp2seg, seg2body, 4, 6)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if table.NumSuperpixels() != len(want) {
+			t.Errorf("%s: loaded %d superpixels, expected %d", name, table.NumSuperpixels(), len(want))
+		}
+		for sp, body := range want {
+			if got, found := table.Lookup(sp); !found || got != body {
+				t.Errorf("%s: superpixel %v has body %d (found %t), expected %d", name, sp, got, found, body)
+			}
+		}
+		for _, z := range []uint32{3, 7} {
+			if table.Slice(z) != nil {
+				t.Errorf("%s: slice %d outside the Z range was loaded", name, z)
+			}
+		}
+	}
+	check("no index")
+
+	if err := BuildSliceIndex(sp2seg); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := readSliceIndex(sp2seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 6 {
+		t.Errorf("slice index has %d runs, expected 6", len(runs))
+	}
+	check("index")
+
+	// Appending to the map makes the index out of date.
+	f, err := os.OpenFile(sp2seg, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("5 2 51\n")
+	f.Close()
+	if runs, err := readSliceIndex(sp2seg); err != nil || runs != nil {
+		t.Fatalf("out-of-date slice index used: %v, %v", runs, err)
+	}
+	want[Superpixel{5, 2}] = 510
+	check("out-of-date index")
+}
+
+// TestSliceIndexErrorPosition checks that errors in lines read using a slice index
+// give their line and column in the whole map.
+func TestSliceIndexErrorPosition(t *testing.T) {
+	sp2seg, seg2body := writeTestMaps(t, t.TempDir())
+	if err := BuildSliceIndex(sp2seg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt line 8 in place, keeping the size and modification time of the map so
+	// the index is still used.
+	fileinfo, err := os.Stat(sp2seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Replace([]byte(testSp2Seg), []byte("6 2 62"), []byte("6 2 6x"), 1)
+	writeTestFile(t, sp2seg, data)
+	if err := os.Chtimes(sp2seg, fileinfo.ModTime(), fileinfo.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if runs, err := readSliceIndex(sp2seg); err != nil || runs == nil {
+		t.Fatalf("slice index not used: %v", err)
+	}
+
+	_, err = LoadBodyTable(sp2seg, seg2body, 6, 6)
+	if err == nil || !strings.Contains(err.Error(), "sp2seg.txt:8:6:") {
+		t.Errorf("expected error at line 8, column 6, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package exporter
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MapError is a parsing or consistency error at a position in a Raveler map file.
+type MapError struct {
+	Filename string
+	Line     int // 1-based line number in the file
+	Column   int // 1-based byte column within the line, or 0 if the whole line is at fault
+	Msg      string
+}
+
+func (e *MapError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Line, e.Column, e.Msg)
+}
+
+// MapReader is a streaming parser for Raveler map files, which have a fixed number of
+// whitespace-separated unsigned integers per line.  Blank lines and lines beginning
+// with '#' or a space are skipped.  Lines may end in LF or CRLF, the last line doesn't
+// need a newline, and gzip-compressed files are decompressed transparently.  Parsing
+// does not allocate memory per line.
+//
+// Text after the expected values, such as the extra columns of some Raveler sessions,
+// is ignored with a warning for the first such line, as the original Sscanf parsing
+// did.  If Strict is set, it's an error instead.
+type MapReader struct {
+	Strict bool
+
+	r        *bufio.Reader
+	filename string
+	ncols    int
+	cols     [4]int // starting column of each value in the current line
+
+	line      int   // line number of the current line
+	lineStart int64 // byte offset of the current line
+	offset    int64 // byte offset of the next line
+
+	long       []byte // holds lines longer than the read buffer
+	warned     bool   // extra columns have been reported
+	compressed bool
+	closer     io.Closer
+}
+
+// MaxMapColumns is the maximum number of values per line a MapReader can parse.
+const MaxMapColumns = 4
+
+// OpenMapFile opens a Raveler map file, which may be gzip compressed, for reading
+// lines of ncols values.  The reader should be closed after use.
+func OpenMapFile(filename string, ncols int) (*MapReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(file, 1<<16)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Could not read gzip-compressed map %s: %s", filename, err.Error())
+		}
+		mr := NewMapReader(gr, filename, ncols)
+		mr.compressed = true
+		mr.closer = file
+		return mr, nil
+	}
+	mr := newMapReader(br, filename, ncols)
+	mr.closer = file
+	return mr, nil
+}
+
+// NewMapReader returns a reader for lines of ncols values from r.  The filename is
+// only used for error messages.
+func NewMapReader(r io.Reader, filename string, ncols int) *MapReader {
+	return newMapReader(bufio.NewReaderSize(r, 1<<16), filename, ncols)
+}
+
+func newMapReader(r *bufio.Reader, filename string, ncols int) *MapReader {
+	if ncols > MaxMapColumns {
+		panic(fmt.Sprintf("MapReader can't parse %d values per line", ncols))
+	}
+	return &MapReader{r: r, filename: filename, ncols: ncols}
+}
+
+// setPosition sets the line number and byte offset of the next line, e.g., after
+// the underlying reader has been positioned within a file.
+func (mr *MapReader) setPosition(line int, offset int64) {
+	mr.line = line - 1
+	mr.offset = offset
+}
+
+// Close closes the underlying file if the reader was created by OpenMapFile.
+func (mr *MapReader) Close() error {
+	if mr.closer == nil {
+		return nil
+	}
+	return mr.closer.Close()
+}
+
+// Compressed returns true if the map file is gzip compressed, in which case offsets
+// are positions in the uncompressed data.
+func (mr *MapReader) Compressed() bool {
+	return mr.compressed
+}
+
+// Line returns the line number of the last line returned by Next.
+func (mr *MapReader) Line() int {
+	return mr.line
+}
+
+// LineOffset returns the byte offset of the last line returned by Next.
+func (mr *MapReader) LineOffset() int64 {
+	return mr.lineStart
+}
+
+// Offset returns the byte offset just past the last line read.
+func (mr *MapReader) Offset() int64 {
+	return mr.offset
+}
+
+// Errorf returns an error for the last line returned by Next.
+func (mr *MapReader) Errorf(format string, args ...interface{}) error {
+	return &MapError{mr.filename, mr.line, 0, fmt.Sprintf(format, args...)}
+}
+
+// Column returns the 1-based byte column of the i-th value of the last line returned by Next.
+func (mr *MapReader) Column(i int) int {
+	return mr.cols[i]
+}
+
+// FieldErrorf returns an error pointing at the i-th value of the last line returned by Next.
+func (mr *MapReader) FieldErrorf(i int, format string, args ...interface{}) error {
+	return &MapError{mr.filename, mr.line, mr.cols[i], fmt.Sprintf(format, args...)}
+}
+
+func (mr *MapReader) readLine() ([]byte, error) {
+	b, err := mr.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		mr.long = append(mr.long[:0], b...)
+		for err == bufio.ErrBufferFull {
+			b, err = mr.r.ReadSlice('\n')
+			mr.long = append(mr.long, b...)
+		}
+		b = mr.long
+	}
+	return b, err
+}
+
+// Next parses the next mapping line into vals, which must hold at least ncols values.
+// It returns io.EOF when there are no more lines and a *MapError for a malformed line.
+func (mr *MapReader) Next(vals []uint64) error {
+	for {
+		b, err := mr.readLine()
+		if len(b) == 0 {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+			return err
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		mr.line++
+		mr.lineStart = mr.offset
+		mr.offset += int64(len(b))
+
+		// Strip line ending.
+		n := len(b)
+		if n > 0 && b[n-1] == '\n' {
+			n--
+		}
+		if n > 0 && b[n-1] == '\r' {
+			n--
+		}
+		b = b[:n]
+		if n == 0 || b[0] == ' ' || b[0] == '#' {
+			continue
+		}
+
+		i := 0
+		for col := 0; col < mr.ncols; col++ {
+			for i < n && (b[i] == ' ' || b[i] == '\t') {
+				i++
+			}
+			mr.cols[col] = i + 1
+			if i == n {
+				return &MapError{mr.filename, mr.line, i + 1, fmt.Sprintf("expected %d values, got %d", mr.ncols, col)}
+			}
+			start := i
+			var v uint64
+			for i < n && b[i] >= '0' && b[i] <= '9' {
+				d := uint64(b[i] - '0')
+				if v > (1<<64-1-d)/10 {
+					return &MapError{mr.filename, mr.line, start + 1, "value overflows 64 bits"}
+				}
+				v = v*10 + d
+				i++
+			}
+			if i == start || (i < n && b[i] != ' ' && b[i] != '\t') {
+				return &MapError{mr.filename, mr.line, i + 1, fmt.Sprintf("unexpected character %q", b[i])}
+			}
+			vals[col] = v
+		}
+		for i < n && (b[i] == ' ' || b[i] == '\t') {
+			i++
+		}
+		if i < n {
+			err := &MapError{mr.filename, mr.line, i + 1, fmt.Sprintf("expected %d values, got extra %q", mr.ncols, b[i])}
+			if mr.Strict {
+				return err
+			}
+			if !mr.warned {
+				fmt.Printf("WARNING: ignoring extra columns in map, first at %s\n", err.Error())
+				mr.warned = true
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readMap returns the values and line numbers of each line of a map, or the error
+// that stopped reading.
+func readMap(mr *MapReader) (vals [][]uint64, lines []int, err error) {
+	for {
+		v := make([]uint64, mr.ncols)
+		if err := mr.Next(v); err == io.EOF {
+			return vals, lines, nil
+		} else if err != nil {
+			return vals, lines, err
+		}
+		vals = append(vals, v)
+		lines = append(lines, mr.Line())
+	}
+}
+
+func TestMapReader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   string
+		strict bool
+		vals   [][]uint64
+		lines  []int
+		err    string // expected error, including position
+	}{
+		{name: "empty", data: ""},
+		{name: "LF", data: "1 2 3\n4 5 6\n", vals: [][]uint64{{1, 2, 3}, {4, 5, 6}}, lines: []int{1, 2}},
+		{name: "CRLF", data: "1 2 3\r\n4 5 6\r\n", vals: [][]uint64{{1, 2, 3}, {4, 5, 6}}, lines: []int{1, 2}},
+		{name: "no final newline", data: "1 2 3\n4 5 6", vals: [][]uint64{{1, 2, 3}, {4, 5, 6}}, lines: []int{1, 2}},
+		{
+			name:  "skipped lines",
+			data:  "# comment\n\n 7 8 9\r\n1\t2  3 \n\r\n4 5 6\n",
+			vals:  [][]uint64{{1, 2, 3}, {4, 5, 6}},
+			lines: []int{4, 6},
+		},
+		{name: "max value", data: "18446744073709551615 0 1\n", vals: [][]uint64{{1<<64 - 1, 0, 1}}, lines: []int{1}},
+		{name: "overflow", data: "1 2 3\n1 18446744073709551616 3\n", err: "test.txt:2:3: value overflows 64 bits"},
+		{name: "too few values", data: "1 2 3\n4 5\n", err: "test.txt:2:4: expected 3 values, got 2"},
+		{name: "bad character", data: "1 2 3\n\n4 5x 6\n", err: "test.txt:3:4: unexpected character 'x'"},
+		{name: "negative value", data: "1 -2 3\n", err: "test.txt:1:3: unexpected character '-'"},
+		{
+			name:  "extra columns ignored",
+			data:  "1 2 3 extra\n4 5 6 7\n",
+			vals:  [][]uint64{{1, 2, 3}, {4, 5, 6}},
+			lines: []int{1, 2},
+		},
+		{name: "extra columns strict", data: "1 2 3\r\n4 5 6 7\r\n", strict: true, err: "test.txt:2:7: expected 3 values, got extra '7'"},
+	} {
+		mr := NewMapReader(strings.NewReader(tc.data), "test.txt", 3)
+		mr.Strict = tc.strict
+		vals, lines, err := readMap(mr)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(vals, tc.vals) || !reflect.DeepEqual(lines, tc.lines) {
+			t.Errorf("%s: got values %v on lines %v, expected %v on lines %v", tc.name, vals, lines, tc.vals, tc.lines)
+		}
+	}
+}
+
+// TestMapReaderOffsets checks the byte offsets of lines, which slice indices use.
+func TestMapReaderOffsets(t *testing.T) {
+	data := "# header\r\n1 2\r\n\r\n3 4\r\n5 6"
+	mr := NewMapReader(strings.NewReader(data), "test.txt", 2)
+	var got []string
+	var vals [2]uint64
+	for mr.Next(vals[:]) == nil {
+		got = append(got, data[mr.LineOffset():mr.Offset()])
+	}
+	if want := []string{"1 2\r\n", "3 4\r\n", "5 6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines at offsets are %q, expected %q", got, want)
+	}
+}
+
+// TestMapReaderLongLine checks a line longer than the read buffer.
+func TestMapReaderLongLine(t *testing.T) {
+	data := "1 2\n" + strings.Repeat(" ", 1<<17) + "\n3" + strings.Repeat("\t", 1<<17) + "4\n5 6\n"
+	vals, lines, err := readMap(NewMapReader(strings.NewReader(data), "test.txt", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, [][]uint64{{1, 2}, {3, 4}, {5, 6}}) || !reflect.DeepEqual(lines, []int{1, 3, 4}) {
+		t.Errorf("got values %v on lines %v", vals, lines)
+	}
+}
+
+// TestOpenMapFileGzip checks that compressed and uncompressed maps read the same,
+// including error positions.
+func TestOpenMapFileGzip(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("# segment body\r\n1 10\r\n2 20\r\n3 3O\r\n")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	writeTestFile(t, filepath.Join(dir, "plain.txt"), data)
+	writeTestFile(t, filepath.Join(dir, "compressed.txt"), gz.Bytes())
+
+	for _, name := range []string{"plain.txt", "compressed.txt"} {
+		mr, err := OpenMapFile(filepath.Join(dir, name), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mr.Compressed() != (name == "compressed.txt") {
+			t.Errorf("%s: compressed is %t", name, mr.Compressed())
+		}
+		vals, lines, err := readMap(mr)
+		mr.Close()
+		if !reflect.DeepEqual(vals, [][]uint64{{1, 10}, {2, 20}}) || !reflect.DeepEqual(lines, []int{2, 3}) {
+			t.Errorf("%s: got values %v on lines %v", name, vals, lines)
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), name+":4:4: unexpected character 'O'") {
+			t.Errorf("%s: expected error at line 4, column 4, got %v", name, err)
+		}
+	}
+}
+
+// TestExtraColumns checks that loading maps ignores extra columns but validating
+// them reports the first.
+func TestExtraColumns(t *testing.T) {
+	sp2seg, seg2body := writeTestMaps(t, t.TempDir())
+	writeTestFile(t, sp2seg, []byte(strings.Replace(testSp2Seg, "5 1 51\n", "5 1 51 0.75\n", 1)))
+	table, err := LoadBodyTable(sp2seg, seg2body, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, found := table.Lookup(Superpixel{5, 1}); !found || body != 510 {
+		t.Errorf("superpixel on line with extra columns has body %d (found %t), expected 510", body, found)
+	}
+	if _, err := ValidateMaps(sp2seg, seg2body); err == nil || !strings.HasSuffix(err.Error(), "sp2seg.txt:5:8: expected 3 values, got extra '0'") {
+		t.Errorf("expected validate to report extra columns, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package exporter
+
+import (
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// newSlabMetadata returns the metadata of a slab written with the given compression.
+func newSlabMetadata(slab Slab, compression string, out []byte) slabs.Metadata {
+	return slabs.Metadata{
+		Version:         slabs.MetadataVersion,
+		Size:            slab.Size,
+		Origin:          slab.Origin,
+		ValidMin:        slab.ValidMin,
+		ValidMax:        slab.ValidMax,
+		DataType:        "uint64",
+		ByteOrder:       "little-endian",
+		Order:           "xyz",
+		Compression:     compression,
+		Bytes:           len(slab.Data),
+		CompressedBytes: len(out),
+		Checksum:        slabs.Checksum(slab.Data),
+		FileChecksum:    slabs.Checksum(out),
+	}
+}
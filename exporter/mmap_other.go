@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package exporter
+
+import "io/ioutil"
+
+// mapFile reads a whole file into memory on systems where we don't memory-map.
+func mapFile(filename string) ([]byte, func() error, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
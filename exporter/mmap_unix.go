@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package exporter
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile memory-maps a file read-only and returns its data with a function to unmap it.
+func mapFile(filename string) ([]byte, func() error, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fileinfo, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fileinfo.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fileinfo.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,383 @@
+package exporter
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Approximate bytes per entry of the Go maps used while loading the text maps.
+const (
+	segMapEntryBytes    = 40 // seg->body map entry
+	bodyIndexEntryBytes = 48 // distinct body entry in BodyTableBuilder
+)
+
+// Plan estimates the resources an export needs from the superpixel image headers and
+// the sizes of the maps, without decoding the images.
+type Plan struct {
+	opts Options
+	roi  *roiMask
+
+	// Superpixel images in the Z range.
+	Zs            []int
+	Width, Height int
+	PixelBytes    int // bytes per pixel of a decoded image
+	FirstImage    string
+
+	// Maps for the Z range.  NumSegments is 0 if a compiled map is used.
+	NumSuperpixels int
+	NumSegments    int
+	TableBytes     int64            // body table for the whole Z range
+	sliceBytes     map[uint32]int64 // body table bytes per slice
+	sliceCounts    map[uint32]int   // superpixels per slice
+
+	// Output.
+	NumLayers   int
+	NumSlabs    int // slabs that will be written, i.e., within the ROI if any
+	SlabBytes   int64
+	OutputBytes map[string]int64 // estimated output per compression
+	SampleImage string           // image used to estimate compression
+
+	Jobs []JobPlan
+}
+
+// JobPlan estimates the resources of one cluster job.
+type JobPlan struct {
+	JobRange
+	NumSlabs    int
+	OutputBytes int64 // estimated output for the chosen compression
+	TableBytes  int64
+	PeakBytes   int64
+	Err         error // set if the job can't run, e.g., MemLimit is too small
+}
+
+// MakePlan estimates the memory, slabs, and output size of an export with the given
+// options, and of each cluster job if the export is split into jobs of filesPerJob
+// images.  It reads the image headers and scans the maps without building the body
+// table.  Compression ratios are estimated by compressing the superpixel ids of one
+// slab-sized region of a single image.
+func MakePlan(opts Options, filesPerJob int) (*Plan, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Plan{opts: opts}
+
+	// Read the image headers.
+	src := NewPNGDirSource(opts.SuperpixelDir)
+	files, err := src.files(opts.MinZ, opts.MaxZ)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no superpixel images in %s for Z %d to %d", opts.SuperpixelDir, opts.MinZ, opts.MaxZ)
+	}
+	for i, f := range files {
+		config, err := readPNGConfig(f.path)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			p.Width, p.Height, p.FirstImage = config.Width, config.Height, f.path
+			switch config.ColorModel {
+			case color.Gray16Model:
+				p.PixelBytes = 2
+			case color.RGBAModel, color.NRGBAModel:
+				p.PixelBytes = 4
+			default:
+				return nil, fmt.Errorf("Unable to use superpixel image %q with color model %T", f.path, config.ColorModel)
+			}
+		} else if config.Width != p.Width || config.Height != p.Height {
+			return nil, fmt.Errorf("superpixel image changes sizes: expected %d x %d and got %d x %d: %s",
+				p.Width, p.Height, config.Width, config.Height, f.path)
+		}
+		p.Zs = append(p.Zs, f.z)
+	}
+
+	if err := p.sizeMaps(); err != nil {
+		return nil, err
+	}
+	if err := p.countSlabs(); err != nil {
+		return nil, err
+	}
+	if err := p.sampleCompression(files[len(files)/2].path); err != nil {
+		return nil, err
+	}
+	if filesPerJob > 0 {
+		p.planJobs(filesPerJob)
+	}
+	return p, nil
+}
+
+func readPNGConfig(filename string) (image.Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("Unable to open superpixel image %q", filename)
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("Unable to read header of superpixel image %q: %s", filename, err.Error())
+	}
+	return config, nil
+}
+
+// sizeMaps estimates the body table size per slice, either from the compiled map or
+// by counting the superpixels and largest label of each slice in the text map.
+func (p *Plan) sizeMaps() error {
+	p.sliceBytes = make(map[uint32]int64)
+	p.sliceCounts = make(map[uint32]int)
+	if p.opts.BodyMap != "" {
+		t, err := OpenCompiledMap(p.opts.BodyMap)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		for z, sb := range t.slices {
+			if int64(z) >= int64(p.opts.MinZ) && int64(z) <= int64(p.opts.MaxZ) {
+				p.sliceBytes[z] = int64(sb.bytes())
+				p.sliceCounts[z] = sb.NumLabels()
+				p.NumSuperpixels += p.sliceCounts[z]
+			}
+		}
+		p.TableBytes = int64(t.Bytes())
+		return nil
+	}
+
+	mr, err := OpenMapFile(p.opts.SegmentToBody, 2)
+	if err != nil {
+		return fmt.Errorf("Could not open segment->body map: %s", p.opts.SegmentToBody)
+	}
+	var vals [2]uint64
+	for {
+		err := mr.Next(vals[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			mr.Close()
+			return err
+		}
+		p.NumSegments++
+	}
+	mr.Close()
+
+	maxLabels := make(map[uint32]uint64)
+	err = scanSuperpixelMap(p.opts.SuperpixelToSegment, p.opts.MinZ, p.opts.MaxZ, func(mr *MapReader, slice, superpixel, segment uint64) error {
+		if superpixel == 0 {
+			return nil
+		}
+		z := uint32(slice)
+		p.sliceCounts[z]++
+		if superpixel > maxLabels[z] {
+			maxLabels[z] = superpixel
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Slices are stored densely if the largest label is less than twice the number
+	// of labels, as in BodyTableBuilder.Build.
+	for z, n := range p.sliceCounts {
+		bytes := int64(8 * n)
+		if maxLabels[z] < uint64(2*n) {
+			bytes = int64(4 * (maxLabels[z] + 1))
+		}
+		p.sliceBytes[z] = bytes + 64
+		p.TableBytes += p.sliceBytes[z]
+		p.NumSuperpixels += n
+	}
+	p.TableBytes += 8 * int64(p.NumSegments) // at most one body per segment
+	return nil
+}
+
+// countSlabs counts the slabs of each layer, skipping those outside the ROI.
+func (p *Plan) countSlabs() error {
+	var roi *roiMask
+	if p.opts.ROIFile != "" {
+		var err error
+		if roi, err = loadROI(p.opts.ROIFile, p.opts.ROIBlockSize); err != nil {
+			return err
+		}
+	}
+	p.SlabBytes = int64(p.opts.SlabX) * int64(p.opts.SlabY) * int64(p.opts.SlabZ) * 8
+	for _, job := range p.opts.SplitJobs(p.Zs, 1) {
+		p.NumLayers++
+		p.NumSlabs += p.layerSlabs(roi, p.opts.ZHead(job.MinZ))
+	}
+	p.roi = roi
+	return nil
+}
+
+// layerSlabs returns the number of slabs written for the layer starting at zoffset.
+func (p *Plan) layerSlabs(roi *roiMask, zoffset int) int {
+	var n int
+	for oy := 0; oy < p.Height; oy += p.opts.SlabY {
+		for ox := 0; ox < p.Width; ox += p.opts.SlabX {
+			if roi == nil || roi.intersects(ox, ox+p.opts.SlabX, oy, oy+p.opts.SlabY, zoffset, zoffset+p.opts.SlabZ) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// sampleCompression estimates the output size for each compression by compressing
+// the superpixel ids of a slab-sized region in the middle of an image.  Body labels
+// usually compress at least as well as superpixel ids.  The image is read one row at
+// a time and only the sampled rows are kept, so memory doesn't grow with the image.
+func (p *Plan) sampleCompression(filename string) error {
+	r, err := openPNGRows(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	p.SampleImage = filename
+
+	sx, sy := p.opts.SlabX, p.opts.SlabY
+	if sx > r.width {
+		sx = r.width
+	}
+	if sy > r.height {
+		sy = r.height
+	}
+	x0 := (r.width - sx) / 2
+	y0 := (r.height - sy) / 2
+	ids := make([]uint32, r.width)
+	sample := make([]byte, 0, 8*sx*sy)
+	for y := 0; y < y0+sy; y++ {
+		if err := r.next(ids); err != nil {
+			return err
+		}
+		if y < y0 {
+			continue
+		}
+		for _, id := range ids[x0 : x0+sx] {
+			sample = append(sample, byte(id), byte(id>>8), byte(id>>16), 0, 0, 0, 0, 0)
+		}
+	}
+
+	total := int64(p.NumSlabs) * p.SlabBytes
+	p.OutputBytes = make(map[string]int64)
+	for _, compression := range []string{"none", "lz4", "gzip"} {
+		out, err := compress(sample, compression)
+		if err != nil {
+			return err
+		}
+		p.OutputBytes[compression] = int64(float64(total) * float64(len(out)) / float64(len(sample)))
+	}
+	return nil
+}
+
+// peakBytes estimates the peak memory of an export of the given slices whose body
+// table takes tableBytes.
+func (p *Plan) peakBytes(zs []int, tableBytes int64) (int64, error) {
+	var pipeline int64
+	if p.opts.MemLimit > 0 {
+		_, bytes, err := p.opts.bandMemory(p.Width, p.Height, tableBytes)
+		if err != nil {
+			return bytes, err
+		}
+		pipeline = bytes - tableBytes
+	} else {
+		nxy := int64(p.Width) * int64(p.Height)
+		layers := int64(p.opts.WriteQueue+1) * nxy * int64(p.opts.SlabZ) * 8
+		images := int64(p.opts.DecodeWorkers+1) * nxy * int64(p.PixelBytes)
+		pipeline = layers + images + p.opts.slabMemory()
+	}
+	peak := tableBytes + pipeline
+	if p.opts.BodyMap == "" {
+		// While loading the text maps, the seg->body map and builder are in memory.
+		var n int64
+		for _, z := range zs {
+			n += int64(p.sliceCounts[uint32(z)])
+		}
+		load := segMapEntryBytes*int64(p.NumSegments) + bodyIndexEntryBytes*int64(p.NumSegments) + 8*n + tableBytes
+		if load > peak {
+			peak = load
+		}
+	}
+	return peak, nil
+}
+
+// planJobs estimates the resources of each cluster job.
+func (p *Plan) planJobs(filesPerJob int) {
+	ratio := float64(p.OutputBytes[p.opts.Compression]) / float64(int64(p.NumSlabs)*p.SlabBytes)
+	var i int
+	for _, job := range p.opts.SplitJobs(p.Zs, filesPerJob) {
+		jp := JobPlan{JobRange: job}
+		zs := p.Zs[i : i+job.Files]
+		i += job.Files
+
+		// Jobs with a compiled map memory-map all of it.
+		jp.TableBytes = p.TableBytes
+		if p.opts.BodyMap == "" {
+			jp.TableBytes = 8 * int64(p.NumSegments)
+			for _, z := range zs {
+				jp.TableBytes += p.sliceBytes[uint32(z)]
+			}
+		}
+		for _, layer := range p.opts.SplitJobs(zs, 1) {
+			jp.NumSlabs += p.layerSlabs(p.roi, p.opts.ZHead(layer.MinZ))
+		}
+		if p.NumSlabs != 0 {
+			jp.OutputBytes = int64(ratio * float64(int64(jp.NumSlabs)*p.SlabBytes))
+		}
+		jp.PeakBytes, jp.Err = p.peakBytes(zs, jp.TableBytes)
+		p.Jobs = append(p.Jobs, jp)
+	}
+}
+
+// Report writes the plan in human-readable form.
+func (p *Plan) Report(w io.Writer) {
+	kind := "16-bit grayscale"
+	if p.PixelBytes == 4 {
+		kind = "RGB(A)"
+	}
+	fmt.Fprintf(w, "Superpixel images: %d %s images of %d x %d pixels, Z %d to %d\n",
+		len(p.Zs), kind, p.Width, p.Height, p.Zs[0], p.Zs[len(p.Zs)-1])
+	if p.opts.BodyMap != "" {
+		fmt.Fprintf(w, "Compiled map: %d superpixels in Z range, %s memory-mapped\n",
+			p.NumSuperpixels, humanBytes(p.TableBytes))
+	} else {
+		fmt.Fprintf(w, "Maps: %d superpixels in Z range, %d segments, superpixel->body table about %s\n",
+			p.NumSuperpixels, p.NumSegments, humanBytes(p.TableBytes))
+	}
+	fmt.Fprintf(w, "Slabs: %d layers, %d slabs of %d x %d x %d voxels (%s each)",
+		p.NumLayers, p.NumSlabs, p.opts.SlabX, p.opts.SlabY, p.opts.SlabZ, humanBytes(p.SlabBytes))
+	if p.roi != nil {
+		fmt.Fprintf(w, " within ROI")
+	}
+	fmt.Fprintf(w, "\nOutput: none %s, lz4 about %s, gzip about %s (ratios from %s)\n",
+		humanBytes(p.OutputBytes["none"]), humanBytes(p.OutputBytes["lz4"]), humanBytes(p.OutputBytes["gzip"]),
+		filepath.Base(p.SampleImage))
+
+	if peak, err := p.peakBytes(p.Zs, p.TableBytes); err != nil {
+		fmt.Fprintf(w, "Peak memory for a single job: %s\n", err.Error())
+	} else {
+		fmt.Fprintf(w, "Peak memory for a single job: about %s\n", humanBytes(peak))
+	}
+	if p.opts.MemLimit > 0 {
+		if bandY, _, err := p.opts.bandMemory(p.Width, p.Height, p.TableBytes); err == nil {
+			fmt.Fprintf(w, "Memory limit %s: layers processed in bands of %d rows\n", humanBytes(p.opts.MemLimit), bandY)
+		}
+	}
+
+	if len(p.Jobs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d cluster jobs (%s output):\n", len(p.Jobs), p.opts.Compression)
+	for i, job := range p.Jobs {
+		fmt.Fprintf(w, "  job %d: Z %d to %d, %d images, %d slabs, output about %s, superpixel->body table %s, ",
+			i, job.MinZ, job.MaxZ, job.Files, job.NumSlabs, humanBytes(job.OutputBytes), humanBytes(job.TableBytes))
+		if job.Err != nil {
+			fmt.Fprintf(w, "%s\n", job.Err.Error())
+		} else {
+			fmt.Fprintf(w, "peak memory about %s\n", humanBytes(job.PeakBytes))
+		}
+	}
+}
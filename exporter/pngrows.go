@@ -0,0 +1,261 @@
+package exporter
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// PNG color types and the filter types of each row.
+const (
+	pngGray      = 0
+	pngTruecolor = 2
+	pngTrueAlpha = 6
+
+	pngFilterNone    = 0
+	pngFilterSub     = 1
+	pngFilterUp      = 2
+	pngFilterAverage = 3
+	pngFilterPaeth   = 4
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngRowReader decodes a superpixel PNG one row at a time, so slices too large to
+// hold in memory can be processed in bands of rows.  It handles the non-interlaced
+// formats Raveler writes: 16-bit grayscale and 8-bit RGB or RGBA.  Other formats are
+// rejected when the image is opened.  Interlaced images of these formats can't be read
+// a row at a time, but can still be exported without -memlimit.
+type pngRowReader struct {
+	name   string
+	file   *os.File
+	width  int
+	height int
+	format SuperpixelFormat
+	bpp    int // bytes per pixel
+
+	zr   io.ReadCloser
+	cur  []byte // filter type and data of the current row
+	prev []byte // data of the previous row
+	y    int    // # of rows read
+}
+
+// openPNGRows reads the header of a superpixel PNG and prepares to read its rows.
+func openPNGRows(filename string) (*pngRowReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open superpixel image %q", filename)
+	}
+	r := &pngRowReader{name: filename, file: file}
+	if err := r.init(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to decode superpixel image %q: %s", filename, err.Error())
+	}
+	return r, nil
+}
+
+func (r *pngRowReader) init() error {
+	br := bufio.NewReaderSize(r.file, 1<<16)
+	var sig [8]byte
+	if _, err := io.ReadFull(br, sig[:]); err != nil || string(sig[:]) != pngSignature {
+		return fmt.Errorf("not a PNG file")
+	}
+	idat := &idatReader{r: br, crc: crc32.NewIEEE()}
+	typ, length, err := idat.chunkHeader()
+	if err != nil {
+		return err
+	}
+	if typ != "IHDR" || length != 13 {
+		return fmt.Errorf("missing IHDR chunk")
+	}
+	var ihdr [13]byte
+	if _, err := io.ReadFull(br, ihdr[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(br, make([]byte, 4)); err != nil { // CRC
+		return err
+	}
+	r.width = int(binary.BigEndian.Uint32(ihdr[0:4]))
+	r.height = int(binary.BigEndian.Uint32(ihdr[4:8]))
+	depth, color, interlace := ihdr[8], ihdr[9], ihdr[12]
+	switch {
+	case color == pngGray && depth == 16:
+		r.format, r.bpp = Superpixel16Bits, 2
+	case color == pngTruecolor && depth == 8:
+		r.format, r.bpp = Superpixel24Bits, 3
+	case color == pngTrueAlpha && depth == 8:
+		r.format, r.bpp = Superpixel24Bits, 4
+	default:
+		return fmt.Errorf("can't read rows of PNG with color type %d and bit depth %d", color, depth)
+	}
+	if interlace != 0 {
+		return fmt.Errorf("can't read rows of interlaced PNG; export without -memlimit")
+	}
+
+	// Skip ancillary chunks up to the image data.
+	for {
+		if typ, length, err = idat.chunkHeader(); err != nil {
+			return err
+		}
+		if typ == "IDAT" {
+			break
+		}
+		if typ == "IEND" {
+			return fmt.Errorf("no image data")
+		}
+		if _, err := br.Discard(int(length) + 4); err != nil {
+			return err
+		}
+	}
+	idat.remaining = length
+	idat.crc.Reset()
+	idat.crc.Write([]byte(typ))
+	if r.zr, err = zlib.NewReader(idat); err != nil {
+		return err
+	}
+	rowBytes := r.width * r.bpp
+	r.cur = make([]byte, 1+rowBytes)
+	r.prev = make([]byte, rowBytes)
+	return nil
+}
+
+// Close closes the image file.
+func (r *pngRowReader) Close() error {
+	if r.zr != nil {
+		r.zr.Close()
+	}
+	return r.file.Close()
+}
+
+// next decodes the next row into its superpixel ids, which must hold the image width.
+func (r *pngRowReader) next(ids []uint32) error {
+	if r.y == r.height {
+		return io.EOF
+	}
+	if _, err := io.ReadFull(r.zr, r.cur); err != nil {
+		return fmt.Errorf("Unable to decode row %d of superpixel image %q: %s", r.y, r.name, err.Error())
+	}
+	ft, cur, prev, bpp := r.cur[0], r.cur[1:], r.prev, r.bpp
+	switch ft {
+	case pngFilterNone:
+	case pngFilterSub:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case pngFilterUp:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case pngFilterAverage:
+		for i := 0; i < bpp; i++ {
+			cur[i] += prev[i] / 2
+		}
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += uint8((int(cur[i-bpp]) + int(prev[i])) / 2)
+		}
+	case pngFilterPaeth:
+		for i := 0; i < bpp; i++ {
+			cur[i] += prev[i]
+		}
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += paeth(cur[i-bpp], prev[i], prev[i-bpp])
+		}
+	default:
+		return fmt.Errorf("Unable to decode row %d of superpixel image %q: bad filter type %d", r.y, r.name, ft)
+	}
+
+	ids = ids[:r.width]
+	switch r.bpp {
+	case 2:
+		for i := range ids {
+			ids[i] = uint32(cur[2*i])<<8 | uint32(cur[2*i+1])
+		}
+	case 3:
+		for i := range ids {
+			p := cur[3*i : 3*i+3]
+			ids[i] = uint32(p[2])<<16 | uint32(p[1])<<8 | uint32(p[0])
+		}
+	case 4:
+		rgbaRow(cur, ids)
+	}
+	copy(r.prev, cur)
+	r.y++
+	return nil
+}
+
+// paeth returns the Paeth predictor of PNG filter type 4.
+func paeth(a, b, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// idatReader returns the data of consecutive IDAT chunks, checking their CRCs.
+type idatReader struct {
+	r         *bufio.Reader
+	crc       hash.Hash32
+	remaining uint32 // bytes left in the current chunk
+	done      bool
+}
+
+// chunkHeader reads the length and type of the next chunk.
+func (ir *idatReader) chunkHeader() (typ string, length uint32, err error) {
+	var header [8]byte
+	if _, err := io.ReadFull(ir.r, header[:]); err != nil {
+		return "", 0, err
+	}
+	return string(header[4:8]), binary.BigEndian.Uint32(header[0:4]), nil
+}
+
+func (ir *idatReader) Read(p []byte) (int, error) {
+	for ir.remaining == 0 {
+		if ir.done {
+			return 0, io.EOF
+		}
+		var crc [4]byte
+		if _, err := io.ReadFull(ir.r, crc[:]); err != nil {
+			return 0, err
+		}
+		if binary.BigEndian.Uint32(crc[:]) != ir.crc.Sum32() {
+			return 0, fmt.Errorf("IDAT checksum mismatch")
+		}
+		typ, length, err := ir.chunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			ir.done = true
+			return 0, io.EOF
+		}
+		ir.remaining = length
+		ir.crc.Reset()
+		ir.crc.Write([]byte(typ))
+	}
+	if uint32(len(p)) > ir.remaining {
+		p = p[:ir.remaining]
+	}
+	n, err := ir.r.Read(p)
+	ir.crc.Write(p[:n])
+	ir.remaining -= uint32(n)
+	return n, err
+}
@@ -0,0 +1,280 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePNGChunk appends a PNG chunk with its CRC.
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	buf.Write(n[:])
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	buf.Write(n[:])
+}
+
+// encodeFilteredPNG encodes rows of raw pixel data as a PNG, using filter type
+// y % 5 for row y so that every filter is used, with the image data split into IDAT
+// chunks of at most chunkSize bytes after an ancillary chunk.
+func encodeFilteredPNG(width, height int, colorType, depth, interlace byte, rows [][]byte, chunkSize int) []byte {
+	bpp := len(rows[0]) / width
+	var idat bytes.Buffer
+	zw := zlib.NewWriter(&idat)
+	prev := make([]byte, len(rows[0]))
+	for y, cur := range rows {
+		ft := byte(y % 5)
+		out := make([]byte, len(cur))
+		for i := range cur {
+			var a, c byte
+			if i >= bpp {
+				a, c = cur[i-bpp], prev[i-bpp]
+			}
+			b := prev[i]
+			switch ft {
+			case pngFilterNone:
+				out[i] = cur[i]
+			case pngFilterSub:
+				out[i] = cur[i] - a
+			case pngFilterUp:
+				out[i] = cur[i] - b
+			case pngFilterAverage:
+				out[i] = cur[i] - byte((int(a)+int(b))/2)
+			case pngFilterPaeth:
+				out[i] = cur[i] - paeth(a, b, c)
+			}
+		}
+		zw.Write([]byte{ft})
+		zw.Write(out)
+		prev = cur
+	}
+	zw.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8], ihdr[9], ihdr[12] = depth, colorType, interlace
+	writePNGChunk(&buf, "IHDR", ihdr)
+	writePNGChunk(&buf, "tEXt", []byte("Software\x00raveler"))
+	data := idat.Bytes()
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		writePNGChunk(&buf, "IDAT", data[:n])
+		data = data[n:]
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+// checkPNGRows checks that the rows read from a PNG match the superpixel ids of the
+// image decoded by image/png.
+func checkPNGRows(t *testing.T, name string, data []byte) {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	plane, err := NewPlane(0, img, name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	filename := filepath.Join(t.TempDir(), "superpixel_map.00000.png")
+	writeTestFile(t, filename, data)
+	r, err := openPNGRows(filename)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer r.Close()
+	bounds := img.Bounds()
+	if r.width != bounds.Dx() || r.height != bounds.Dy() || r.format != plane.Format {
+		t.Fatalf("%s: row reader has %d x %d image of format %v, expected %d x %d of format %v",
+			name, r.width, r.height, r.format, bounds.Dx(), bounds.Dy(), plane.Format)
+	}
+	got := make([]uint32, r.width)
+	want := make([]uint32, r.width)
+	for y := 0; y < r.height; y++ {
+		if err := r.next(got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := superpixelRow(img, plane.Format, y, 0, r.width, want); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for x := range got {
+			if got[x] != want[x] {
+				t.Fatalf("%s: pixel (%d, %d) is %d, expected %d", name, x, y, got[x], want[x])
+			}
+		}
+	}
+	if err := r.next(got); err != io.EOF {
+		t.Errorf("%s: expected EOF after last row, got %v", name, err)
+	}
+}
+
+// TestPNGRowsMatchDecoder compares rows read from PNGs written by image/png and
+// with every filter type against images decoded by image/png.
+func TestPNGRowsMatchDecoder(t *testing.T) {
+	const width, height = 37, 23
+	rng := rand.New(rand.NewSource(1))
+	gray := image.NewGray16(image.Rect(0, 0, width, height))
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Mostly repeated ids, like superpixel images, with some noise.
+			id := uint32(x/5+y/3*8) * 2654435761
+			if rng.Intn(4) == 0 {
+				id = rng.Uint32()
+			}
+			gray.SetGray16(x, y, color.Gray16{uint16(id)})
+			rgba.SetRGBA(x, y, color.RGBA{uint8(id), uint8(id >> 8), uint8(id >> 16), 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(id), uint8(id >> 8), uint8(id >> 16), uint8(id >> 24)})
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"16-bit gray", gray},
+		{"8-bit RGB", rgba}, // opaque RGBA is written without alpha
+		{"8-bit RGBA", nrgba},
+	} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, tc.img); err != nil {
+			t.Fatal(err)
+		}
+		checkPNGRows(t, tc.name, buf.Bytes())
+	}
+
+	for _, tc := range []struct {
+		name      string
+		colorType byte
+		depth     byte
+		bpp       int
+	}{
+		{"filtered 16-bit gray", pngGray, 16, 2},
+		{"filtered 8-bit RGB", pngTruecolor, 8, 3},
+		{"filtered 8-bit RGBA", pngTrueAlpha, 8, 4},
+	} {
+		rows := make([][]byte, height)
+		for y := range rows {
+			rows[y] = make([]byte, width*tc.bpp)
+			rng.Read(rows[y])
+		}
+		checkPNGRows(t, tc.name, encodeFilteredPNG(width, height, tc.colorType, tc.depth, 0, rows, 100))
+	}
+}
+
+// TestPNGRowsUnsupported checks that formats that can't be read a row at a time are
+// rejected when opened.
+func TestPNGRowsUnsupported(t *testing.T) {
+	const width, height = 16, 8
+	paletted := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+	gray8 := image.NewGray(image.Rect(0, 0, width, height))
+	rgba64 := image.NewRGBA64(image.Rect(0, 0, width, height))
+	rgba64.SetRGBA64(1, 1, color.RGBA64{1, 2, 3, 4})
+	grayRows := make([][]byte, height)
+	for y := range grayRows {
+		grayRows[y] = make([]byte, 2*width)
+	}
+
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		data []byte
+		err  string
+	}{
+		{name: "paletted", img: paletted, err: "color type 3 and bit depth 1"},
+		{name: "8-bit gray", img: gray8, err: "color type 0 and bit depth 8"},
+		{name: "16-bit RGBA", img: rgba64, err: "color type 6 and bit depth 16"},
+		{name: "interlaced", data: encodeFilteredPNG(width, height, pngGray, 16, 1, grayRows, 100), err: "interlaced"},
+		{name: "not a PNG", data: []byte("GIF89a"), err: "not a PNG file"},
+	} {
+		data := tc.data
+		if tc.img != nil {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, tc.img); err != nil {
+				t.Fatal(err)
+			}
+			data = buf.Bytes()
+		}
+		filename := filepath.Join(t.TempDir(), "superpixel_map.00000.png")
+		writeTestFile(t, filename, data)
+		r, err := openPNGRows(filename)
+		if err == nil {
+			r.Close()
+			t.Errorf("%s: opened PNG without error", tc.name)
+		} else if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+// TestPNGRowsCorrupted checks that truncated or corrupted image data gives an error
+// rather than short rows.
+func TestPNGRowsCorrupted(t *testing.T) {
+	const width, height = 40, 30
+	rng := rand.New(rand.NewSource(2))
+	rows := make([][]byte, height)
+	for y := range rows {
+		rows[y] = make([]byte, 3*width)
+		rng.Read(rows[y])
+	}
+	data := encodeFilteredPNG(width, height, pngTruecolor, 8, 0, rows, 500)
+	idat := bytes.Index(data, []byte("IDAT")) // the first chunk's CRC follows 500 bytes of data
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated IDAT", data[:idat+4+1000], "Unable to decode row"},
+		{"missing IEND", data[:len(data)-12], ""},
+		{"bad IDAT checksum", flipByte(data, idat+4+500), "checksum mismatch"},
+	} {
+		filename := filepath.Join(t.TempDir(), "superpixel_map.00000.png")
+		writeTestFile(t, filename, tc.data)
+		r, err := openPNGRows(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ids := make([]uint32, width)
+		for err == nil {
+			err = r.next(ids)
+		}
+		r.Close()
+		if tc.err == "" {
+			if err != io.EOF {
+				t.Errorf("%s: expected all rows to be read, got %v", tc.name, err)
+			}
+		} else if err == io.EOF || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+// flipByte returns a copy of data with one bit of a byte changed.
+func flipByte(data []byte, i int) []byte {
+	data = append([]byte(nil), data...)
+	data[i] ^= 1
+	return data
+}
@@ -0,0 +1,717 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"reflect"
+	"sync"
+
+	"image/color"
+)
+
+// SuperpixelFormat notes whether superpixel ids, if present,
+// are in 16-bit or 24-bit values.
+type SuperpixelFormat uint8
+
+// Enumerate the types of superpixel id formats
+const (
+	SuperpixelNone SuperpixelFormat = iota
+	Superpixel16Bits
+	Superpixel24Bits
+)
+
+// Superpixel is a Raveler-oriented description of a superpixel that
+// breaks a unique superpixel id into two components: a slice and a
+// unique label within that slice.
+type Superpixel struct {
+	Slice uint32
+	Label uint32
+}
+
+// Span is (Z, Y, X0, X1).
+// TODO -- Consolidate with dvid.RLE since both handle run-length encodings in X, although
+// dvid.RLE handles voxel coordinates not block (chunk) coordinates.
+type Span [4]int
+
+func (s Span) String() string {
+	return fmt.Sprintf("[%d, %d, %d, %d]", s[0], s[1], s[2], s[3])
+}
+
+// Extends returns true and modifies the span if the given point
+// is one more in x direction than this span.  Else it returns false.
+func (s *Span) Extends(x, y, z int) bool {
+	if s == nil || (*s)[0] != z || (*s)[1] != y || (*s)[3] != x-1 {
+		return false
+	}
+	(*s)[3] = x
+	return true
+}
+
+func (s Span) Unpack() (z, y, x0, x1 int) {
+	return s[0], s[1], s[2], s[3]
+}
+
+func (s Span) Less(block [3]int) bool {
+	if s[0] < block[2] {
+		return true
+	}
+	if s[0] > block[2] {
+		return false
+	}
+	if s[1] < block[1] {
+		return true
+	}
+	if s[1] > block[1] {
+		return false
+	}
+	if s[3] < block[0] {
+		return true
+	}
+	return false
+}
+
+func (s Span) Includes(block [3]int) bool {
+	if s[0] != block[2] {
+		return false
+	}
+	if s[1] != block[1] {
+		return false
+	}
+	if s[2] > block[0] || s[3] < block[0] {
+		return false
+	}
+	return true
+}
+
+// getSuperpixelId returns the superpixel id given a color.  This routine handles 32-bit
+// and 16-bit superpixel images.  From the Raveler documentation:
+//
+//	16-bit: pixel intensity is superpixel id
+//	32-bit: superpixel id = R + (256 * G) + (65536 * B)
+func getSuperpixelId(c color.Color, format SuperpixelFormat) (id uint32, err error) {
+	switch format {
+	case Superpixel24Bits:
+		switch c.(type) {
+		case color.NRGBA:
+			v := c.(color.NRGBA)
+			id = uint32(v.B)
+			id <<= 8
+			id |= uint32(v.G)
+			id <<= 8
+			id |= uint32(v.R)
+		case color.RGBA:
+			v := c.(color.RGBA)
+			id = uint32(v.B)
+			id <<= 8
+			id |= uint32(v.G)
+			id <<= 8
+			id |= uint32(v.R)
+		default:
+			err = fmt.Errorf("expected 32-bit RGBA superpixels, got %v", reflect.TypeOf(c))
+		}
+	case Superpixel16Bits:
+		id = uint32(c.(color.Gray16).Y)
+	default:
+		err = fmt.Errorf("unknown superpixel format %v", format)
+	}
+	return
+}
+
+// superpixelRow stores the superpixel ids of pixels x0 <= x < x1 in row y of an image
+// into ids.  Gray16, RGBA, and NRGBA images are read directly from their pixel data,
+// and other image types fall back to getSuperpixelId for each pixel.
+func superpixelRow(img image.Image, format SuperpixelFormat, y, x0, x1 int, ids []uint32) error {
+	ids = ids[:x1-x0]
+	switch src := img.(type) {
+	case *image.Gray16:
+		if format == Superpixel16Bits {
+			pix := src.Pix[src.PixOffset(x0, y):]
+			pix = pix[:2*len(ids)]
+			for i := range ids {
+				ids[i] = uint32(pix[2*i])<<8 | uint32(pix[2*i+1])
+			}
+			return nil
+		}
+	case *image.RGBA:
+		if format == Superpixel24Bits {
+			rgbaRow(src.Pix[src.PixOffset(x0, y):], ids)
+			return nil
+		}
+	case *image.NRGBA:
+		if format == Superpixel24Bits {
+			rgbaRow(src.Pix[src.PixOffset(x0, y):], ids)
+			return nil
+		}
+	}
+	var err error
+	for i := range ids {
+		if ids[i], err = getSuperpixelId(img.At(x0+i, y), format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rgbaRow computes superpixel ids R + (256 * G) + (65536 * B) from 4-byte pixels.
+func rgbaRow(pix []uint8, ids []uint32) {
+	pix = pix[:4*len(ids)]
+	for i := range ids {
+		p := pix[4*i : 4*i+3]
+		ids[i] = uint32(p[2])<<16 | uint32(p[1])<<8 | uint32(p[0])
+	}
+}
+
+func (e *Exporter) processRavelerExport() error {
+	if e.opts.Supervoxels {
+		if err := e.checkLabelmaps(); err != nil {
+			return err
+		}
+	}
+	if err := e.checkBlocksInstances(); err != nil {
+		return err
+	}
+
+	// If we have roi, load it.
+	var roi *roiMask
+	if e.opts.ROIFile != "" {
+		var err error
+		if roi, err = loadROI(e.opts.ROIFile, e.opts.ROIBlockSize); err != nil {
+			return err
+		}
+	}
+
+	// Record progress so a failed export can be resumed.
+	if !e.opts.DryRun {
+		var err error
+		if e.manifest, err = openManifest(e.opts); err != nil {
+			return err
+		}
+		defer func() {
+			e.manifest.Close()
+			e.manifest = nil
+		}()
+	}
+
+	// Get the sp->body map for the slices we need.
+	sp2body, err := e.opts.BodyTable()
+	if err != nil {
+		return err
+	}
+	defer sp2body.Close()
+
+	// Read in an transform each superpixel image.
+	unmapped := newUnmappedReport(e.opts.Unmapped)
+	if e.opts.MemLimit > 0 {
+		err = e.transformBands(sp2body, roi, unmapped)
+	} else {
+		err = e.transformImages(sp2body, roi, unmapped)
+	}
+
+	if unmapped.NumSuperpixels != 0 {
+		fmt.Printf("Found %d unmapped superpixels covering %d voxels in %d slices\n",
+			unmapped.NumSuperpixels, unmapped.NumVoxels, len(unmapped.Slices))
+		if e.opts.OutDir != "" && !e.opts.DryRun {
+			if rerr := unmapped.WriteJSON(e.opts.OutDir); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+	if derr := e.writeDVIDChecks(); err == nil {
+		err = derr
+	}
+	if err == nil && e.opts.Supervoxels {
+		err = e.writeMappings(sp2body, unmapped)
+	}
+	return err
+}
+
+type layerT struct {
+	buf  []uint64
+	nx   int
+	ny   int
+	nz   int
+	nxy  int
+	nxyz int
+	y0   int // Y of the first row, if the layer only holds a band of rows
+	z0   int // range of Z slices with images, z0 <= z < z1
+	z1   int
+}
+
+func (e *Exporter) transformImages(sp2body *BodyTable, roi *roiMask, unmapped *UnmappedReport) error {
+	// Read all superpixel planes, transform them, and write to the sink.
+	var (
+		layer   layerT
+		writer  *layerWriter
+		zoffset int // the starting z of current output buffer
+		zInBuf  int // # of Z slices stored in output buffer
+		first   bool
+	)
+	first = true
+	err := e.source.Walk(e.opts.MinZ, e.opts.MaxZ, func(plane Plane) error {
+		tlog := NewTimeLog()
+
+		z := plane.Z
+
+		// Allocate buffer if not already allocated.
+		b := plane.Image.Bounds()
+		if writer == nil {
+			layer.nx, layer.ny = b.Dx(), b.Dy()
+			layer.nz = e.opts.SlabZ
+			layer.nxy = layer.nx * layer.ny
+			layer.nxyz = layer.nxy * layer.nz
+			writer = e.newLayerWriter(layer.nxyz, roi)
+			layer.buf = writer.buffer()
+		} else if layer.nx != b.Dx() || layer.ny != b.Dy() {
+			return fmt.Errorf("superpixel image changes sizes: expected %d x %d and got %d x %d: %s",
+				layer.nx, layer.ny, b.Dx(), b.Dy(), plane.Name)
+		}
+
+		if first {
+			zoffset = e.opts.ZHead(z)
+			first = false
+		}
+
+		// Write past buffer if we are no longer in it
+		if zInBuf != 0 && e.opts.ZHead(z) != zoffset {
+			if err := writer.write(layer, zoffset); err != nil {
+				return err
+			}
+			layer.buf = writer.buffer()
+			zoffset = e.opts.ZHead(z)
+			zInBuf = 0
+		}
+
+		// Transform the image and store bodies into our output buffer.
+		if zInBuf == 0 {
+			layer.z0 = z
+		}
+		layer.z1 = z + 1
+		zInBuf++
+		zbuf := z % layer.nz // z offset into the buffer
+		missing, err := e.relabelPlane(plane, sp2body, roi, layer.buf[zbuf*layer.nxy:(zbuf+1)*layer.nxy])
+		if err != nil {
+			return err
+		}
+		unmapped.addSlice(plane, missing, e.opts)
+		if len(missing) != 0 && e.opts.Unmapped == UnmappedFail {
+			return fmt.Errorf("%d superpixels in slice %d are not in the mapping", len(missing), z)
+		}
+		tlog.Printf("Processed superpixel image, %s", plane.Name)
+		return nil
+	})
+	if writer == nil {
+		return err
+	}
+
+	// Make sure we write any unsaved data in output buffer
+	if err == nil && zInBuf != 0 {
+		err = writer.write(layer, zoffset)
+	}
+	if werr := writer.close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// relabeler converts the superpixel ids of one slice to bodies, or to supervoxel ids
+// of every nonzero superpixel if exporting supervoxels, and counts the voxels of
+// unmapped superpixels.
+// Neighboring pixels usually belong to the same superpixel, so the last lookup is
+// remembered.
+type relabeler struct {
+	opts  *Options
+	slice *SliceBodies
+	sp    Superpixel
+
+	lastLabel uint32
+	lastBody  uint64
+	lastFound bool
+
+	missing map[uint32]int // voxel counts of unmapped superpixels
+}
+
+func (e *Exporter) newRelabeler(sp2body *BodyTable, z int) *relabeler {
+	return &relabeler{
+		opts:      &e.opts,
+		slice:     sp2body.Slice(uint32(z)),
+		sp:        Superpixel{Slice: uint32(z)},
+		lastFound: true,
+	}
+}
+
+// relabel stores the body for each superpixel id into out.
+func (r *relabeler) relabel(ids []uint32, out []uint64) {
+	var body uint64
+	var found bool
+	for i, label := range ids {
+		if label == r.lastLabel {
+			body, found = r.lastBody, r.lastFound
+		} else {
+			r.sp.Label = label
+			if label == 0 {
+				body, found = 0, true
+			} else if body, found = r.slice.Body(label); !found {
+				body = r.opts.unmappedBody(r.sp)
+			} else if body != 0 && r.opts.BodyOffset != 0 {
+				body += uint64(r.opts.BodyOffset)
+			}
+			if r.opts.Supervoxels && label != 0 {
+				body = SupervoxelID(r.sp)
+			}
+			r.lastLabel, r.lastBody, r.lastFound = label, body, found
+		}
+		if !found {
+			if r.missing == nil {
+				r.missing = make(map[uint32]int)
+			}
+			r.missing[label]++
+		}
+		out[i] = body
+	}
+}
+
+// rowRanges returns the ranges of row y in slice z that should be relabeled, clipped
+// to x0 <= x < x1.  Without an ROI, this is the whole row.  The ranges are appended
+// to buf[:0].
+func rowRanges(roi *roiMask, y, z, x0, x1 int, buf []xRange) []xRange {
+	if roi == nil {
+		return append(buf[:0], xRange{x0, x1})
+	}
+	ranges := buf[:0]
+	for _, r := range roi.row(y, z) {
+		if r.x0 < x0 {
+			r.x0 = x0
+		}
+		if r.x1 > x1 {
+			r.x1 = x1
+		}
+		if r.x0 < r.x1 {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// relabelPlane stores the body of each pixel of a superpixel plane into dst, which
+// holds one slice of a layer.  If there is an ROI, only pixels within it are stored.
+// Bands of rows are relabeled concurrently by the relabel workers.  It returns the
+// voxel counts of unmapped superpixels.
+func (e *Exporter) relabelPlane(plane Plane, sp2body *BodyTable, roi *roiMask, dst []uint64) (map[uint32]int, error) {
+	img := plane.Image
+	format := plane.Format
+	b := img.Bounds()
+	z := plane.Z
+
+	relabelRows := func(y0, y1 int) (map[uint32]int, error) {
+		r := e.newRelabeler(sp2body, z)
+		ids := make([]uint32, b.Dx())
+		var ranges []xRange
+		for y := y0; y < y1; y++ {
+			out := dst[(y-b.Min.Y)*b.Dx():]
+			ranges = rowRanges(roi, y, z, b.Min.X, b.Max.X, ranges)
+			for _, xr := range ranges {
+				if err := superpixelRow(img, format, y, xr.x0, xr.x1, ids); err != nil {
+					return nil, err
+				}
+				r.relabel(ids[:xr.x1-xr.x0], out[xr.x0-b.Min.X:xr.x1-b.Min.X])
+			}
+		}
+		return r.missing, nil
+	}
+
+	workers := e.opts.RelabelWorkers
+	if workers > b.Dy() {
+		workers = b.Dy()
+	}
+	if workers <= 1 {
+		return relabelRows(b.Min.Y, b.Max.Y)
+	}
+
+	// Relabel bands of rows concurrently, then merge the unmapped counts and return
+	// the error of the first failed band.
+	bands := make([]map[uint32]int, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		y0 := b.Min.Y + w*b.Dy()/workers
+		y1 := b.Min.Y + (w+1)*b.Dy()/workers
+		wg.Add(1)
+		go func(w, y0, y1 int) {
+			defer wg.Done()
+			bands[w], errs[w] = relabelRows(y0, y1)
+		}(w, y0, y1)
+	}
+	wg.Wait()
+
+	var missing map[uint32]int
+	for w := range bands {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+		for label, n := range bands[w] {
+			if missing == nil {
+				missing = make(map[uint32]int)
+			}
+			missing[label] += n
+		}
+	}
+	return missing, nil
+}
+
+// layerWriter writes completed layers in a background goroutine while the next
+// layer is filled.  Layer buffers are recycled once written, so at most
+// WriteQueue + 1 layer buffers are allocated.
+type layerWriter struct {
+	e     *Exporter
+	roi   *roiMask
+	size  int // # of labels in a layer buffer
+	queue chan layerJob
+	free  chan []uint64
+	nbufs int // # of layer buffers allocated
+	done  chan struct{}
+
+	mu  sync.Mutex
+	err error // first write error
+}
+
+type layerJob struct {
+	layer   layerT
+	zoffset int
+}
+
+func (e *Exporter) newLayerWriter(size int, roi *roiMask) *layerWriter {
+	w := &layerWriter{
+		e:    e,
+		roi:  roi,
+		size: size,
+		free: make(chan []uint64, e.opts.WriteQueue+1),
+		done: make(chan struct{}),
+	}
+	if e.opts.WriteQueue == 0 {
+		close(w.done)
+		return w
+	}
+	w.queue = make(chan layerJob, e.opts.WriteQueue)
+	go func() {
+		defer close(w.done)
+		for job := range w.queue {
+			if w.error() == nil {
+				w.setError(e.writeLayer(job.layer, job.zoffset, w.roi))
+			}
+			w.recycle(job.layer.buf)
+		}
+	}()
+	return w
+}
+
+func (w *layerWriter) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *layerWriter) setError(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// recycle zeroes a written layer buffer and makes it available for reuse.
+func (w *layerWriter) recycle(buf []uint64) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	w.free <- buf
+}
+
+// buffer returns a zeroed layer buffer, waiting for a queued layer to be written
+// if all buffers are in use.
+func (w *layerWriter) buffer() []uint64 {
+	select {
+	case buf := <-w.free:
+		return buf
+	default:
+	}
+	if w.nbufs <= w.e.opts.WriteQueue {
+		w.nbufs++
+		return make([]uint64, w.size)
+	}
+	return <-w.free
+}
+
+// write writes a completed layer, in the background if there is a write queue.  The
+// layer's buffer must not be used afterwards.  It returns the first error of any
+// earlier background write.
+func (w *layerWriter) write(layer layerT, zoffset int) error {
+	if w.queue == nil {
+		err := w.e.writeLayer(layer, zoffset, w.roi)
+		w.recycle(layer.buf)
+		return err
+	}
+	if err := w.error(); err != nil {
+		return err
+	}
+	w.queue <- layerJob{layer, zoffset}
+	return nil
+}
+
+// close waits for all queued layers to be written and returns the first write error.
+func (w *layerWriter) close() error {
+	if w.queue != nil {
+		close(w.queue)
+	}
+	<-w.done
+	return w.error()
+}
+
+// slabJob is a slab of a layer to be packed and sent to the sink.
+type slabJob struct {
+	index  int // order of the slab within the layer
+	ox, oy int
+}
+
+// writeLayer packs the slabs of a layer and sends them to the sink using a pool of
+// slab workers.  Slabs outside the ROI, if any, and slabs already recorded in the
+// progress manifest are skipped, and each written slab is recorded.  The number of
+// slabs being packed, compressed or sent at once is limited so their uncompressed
+// size stays within MaxInflightBytes.  After a slab fails, no more slabs are started,
+// and the error of the first failed slab in layer order is returned.
+func (e *Exporter) writeLayer(layer layerT, zoffset int, roi *roiMask) error {
+	tlog := NewTimeLog()
+
+	// Compute some slab indexing
+	sxBytes := e.opts.SlabX * 8
+	sxyBytes := e.opts.SlabY * sxBytes
+	sxyzBytes := e.opts.SlabZ * sxyBytes
+
+	writeSlab := func(ox, oy int) error {
+		endY := oy + e.opts.SlabY
+		if endY > layer.ny {
+			endY = layer.ny
+		}
+		endX := ox + e.opts.SlabX
+		if endX > layer.nx {
+			endX = layer.nx
+		}
+
+		// Store data from slab into the POST buffer
+		slabBuf := make([]byte, sxyzBytes, sxyzBytes)
+		for z := 0; z < e.opts.SlabZ; z++ {
+			sy := 0
+			for y := oy; y < endY; y++ {
+				sx := 0
+				for x := ox; x < endX; x++ {
+					layerI := z*layer.nxy + y*layer.nx + x
+					si := z*sxyBytes + sy*sxBytes + sx*8
+					binary.LittleEndian.PutUint64(slabBuf[si:si+8], layer.buf[layerI])
+					sx++
+				}
+				sy++
+			}
+		}
+
+		// Send the data
+		slab := Slab{
+			Data:     slabBuf,
+			Origin:   [3]int{ox, layer.y0 + oy, zoffset},
+			Size:     [3]int{e.opts.SlabX, e.opts.SlabY, e.opts.SlabZ},
+			ValidMin: [3]int{ox, layer.y0 + oy, layer.z0},
+			ValidMax: [3]int{endX, layer.y0 + endY, layer.z1},
+		}
+		if err := e.sink.WriteSlab(slab); err == ErrSkipped {
+			return nil // kept an existing slab, so it isn't known to hold this data
+		} else if err != nil {
+			return fmt.Errorf("slab @ (%d,%d,%d): %s", ox, layer.y0+oy, zoffset, err.Error())
+		}
+		return e.manifest.record(slab)
+	}
+
+	// Limit the workers so in-flight slabs stay within the memory budget.
+	workers := e.opts.SlabWorkers
+	if e.opts.MaxInflightBytes > 0 {
+		maxSlabs := e.opts.MaxInflightBytes / int64(sxyzBytes)
+		if maxSlabs < 1 {
+			maxSlabs = 1
+		}
+		if int64(workers) > maxSlabs {
+			workers = int(maxSlabs)
+		}
+	}
+
+	// Iterate through all slabs in this layer, sending each one to the sink
+	var jobs []slabJob
+	var skipped, resumed int
+	for oy := 0; oy < layer.ny; oy += e.opts.SlabY {
+		for ox := 0; ox < layer.nx; ox += e.opts.SlabX {
+			y := layer.y0 + oy
+			if roi != nil && !roi.intersects(ox, ox+e.opts.SlabX, y, y+e.opts.SlabY, zoffset, zoffset+e.opts.SlabZ) {
+				skipped++
+				continue
+			}
+			if e.manifest.Done([3]int{ox, y, zoffset}) {
+				resumed++
+				continue
+			}
+			jobs = append(jobs, slabJob{len(jobs), ox, oy})
+		}
+	}
+	if skipped != 0 {
+		fmt.Printf("Skipping %d slabs outside ROI in layer starting at Z %d\n", skipped, zoffset)
+	}
+	if resumed != 0 {
+		fmt.Printf("Skipping %d slabs already written in layer starting at Z %d\n", resumed, zoffset)
+	}
+	if workers <= 1 {
+		for _, job := range jobs {
+			if err := writeSlab(job.ox, job.oy); err != nil {
+				return err
+			}
+		}
+		tlog.Printf("Wrote layer starting at Z %d", zoffset)
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = -1 // index of first failed slab in layer order
+		errs   = make([]error, len(jobs))
+	)
+	queue := make(chan slabJob)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := writeSlab(job.ox, job.oy); err != nil {
+					mu.Lock()
+					errs[job.index] = err
+					if failed < 0 || job.index < failed {
+						failed = job.index
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		mu.Lock()
+		stop := failed >= 0
+		mu.Unlock()
+		if stop {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed >= 0 {
+		return errs[failed]
+	}
+	tlog.Printf("Wrote layer starting at Z %d", zoffset)
+	return nil
+}
@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Size of the synthetic images used to benchmark superpixel decoding.
+const benchWidth, benchHeight = 4096, 2048
+
+// testImages returns a 24-bit RGBA, 24-bit NRGBA, and 16-bit grayscale superpixel
+// image of the given size.
+func testImages(nx, ny int) map[string]Plane {
+	rgba := image.NewRGBA(image.Rect(0, 0, nx, ny))
+	nrgba := image.NewNRGBA(image.Rect(0, 0, nx, ny))
+	gray := image.NewGray16(image.Rect(0, 0, nx, ny))
+	for y := 0; y < ny; y++ {
+		for x := 0; x < nx; x++ {
+			id := uint32(x/13 + (y/11)*5000)
+			rgba.SetRGBA(x, y, color.RGBA{uint8(id), uint8(id >> 8), uint8(id >> 16), 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(id), uint8(id >> 8), uint8(id >> 16), 255})
+			gray.SetGray16(x, y, color.Gray16{uint16(id)})
+		}
+	}
+	return map[string]Plane{
+		"RGBA":   {Image: rgba, Format: Superpixel24Bits},
+		"NRGBA":  {Image: nrgba, Format: Superpixel24Bits},
+		"Gray16": {Image: gray, Format: Superpixel16Bits},
+	}
+}
+
+// TestSuperpixelRow checks that the direct pixel decoding gives the same ids as
+// getSuperpixelId, including for rows that start past the image's left edge.
+func TestSuperpixelRow(t *testing.T) {
+	for name, plane := range testImages(300, 40) {
+		img := plane.Image
+		for _, bounds := range []image.Rectangle{img.Bounds(), image.Rect(17, 5, 250, 33)} {
+			sub := img.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(bounds)
+			ids := make([]uint32, bounds.Dx())
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				if err := superpixelRow(sub, plane.Format, y, bounds.Min.X, bounds.Max.X, ids); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				for i, id := range ids {
+					want, err := getSuperpixelId(sub.At(bounds.Min.X+i, y), plane.Format)
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					if id != want {
+						t.Fatalf("%s: pixel (%d,%d) decoded as %d, expected %d", name, bounds.Min.X+i, y, id, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func benchmarkSuperpixelRow(b *testing.B, name string) {
+	plane := testImages(benchWidth, benchHeight)[name]
+	ids := make([]uint32, benchWidth)
+	b.SetBytes(benchWidth * benchHeight * 4)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for y := 0; y < benchHeight; y++ {
+			if err := superpixelRow(plane.Image, plane.Format, y, 0, benchWidth, ids); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func benchmarkGetSuperpixelId(b *testing.B, name string) {
+	plane := testImages(benchWidth, benchHeight)[name]
+	ids := make([]uint32, benchWidth)
+	b.SetBytes(benchWidth * benchHeight * 4)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for y := 0; y < benchHeight; y++ {
+			for x := range ids {
+				var err error
+				if ids[x], err = getSuperpixelId(plane.Image.At(x, y), plane.Format); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// Compare decoding a whole image with superpixelRow against the per-pixel
+// getSuperpixelId it replaced, e.g., go test -bench Superpixel ./exporter
+func BenchmarkSuperpixelRowRGBA(b *testing.B)     { benchmarkSuperpixelRow(b, "RGBA") }
+func BenchmarkSuperpixelRowGray16(b *testing.B)   { benchmarkSuperpixelRow(b, "Gray16") }
+func BenchmarkGetSuperpixelIdRGBA(b *testing.B)   { benchmarkGetSuperpixelId(b, "RGBA") }
+func BenchmarkGetSuperpixelIdGray16(b *testing.B) { benchmarkGetSuperpixelId(b, "Gray16") }
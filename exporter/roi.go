@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// xRange is a range of voxel X coordinates x0 <= x < x1.
+type xRange struct {
+	x0, x1 int
+}
+
+// roiMask holds the voxel X ranges of an ROI for each row of ROI blocks, so the ROI
+// spans are only searched once instead of for every voxel.
+type roiMask struct {
+	blockSize int
+	rows      map[[2]int][]xRange // sorted, non-adjacent ranges keyed by block (Z, Y)
+}
+
+// newROIMask returns the mask for ROI block spans with the given block size.
+func newROIMask(roi []Span, blockSize int) *roiMask {
+	m := &roiMask{blockSize: blockSize, rows: make(map[[2]int][]xRange)}
+	for _, span := range roi {
+		z, y, x0, x1 := span.Unpack()
+		key := [2]int{z, y}
+		m.rows[key] = append(m.rows[key], xRange{x0 * blockSize, (x1 + 1) * blockSize})
+	}
+	for key, ranges := range m.rows {
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].x0 < ranges[j].x0 })
+		n := 0
+		for _, r := range ranges {
+			if n > 0 && r.x0 <= ranges[n-1].x1 {
+				if r.x1 > ranges[n-1].x1 {
+					ranges[n-1].x1 = r.x1
+				}
+				continue
+			}
+			ranges[n] = r
+			n++
+		}
+		m.rows[key] = ranges[:n]
+	}
+	return m
+}
+
+// loadROI reads a JSON ROI of block spans and returns its mask.
+func loadROI(filename string, blockSize int) (*roiMask, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jsonBytes, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var roi []Span
+	if err := json.Unmarshal(jsonBytes, &roi); err != nil {
+		return nil, fmt.Errorf("Error trying to parse JSON ROI: %s", err.Error())
+	}
+	return newROIMask(roi, blockSize), nil
+}
+
+// row returns the X ranges of the ROI in the row of voxels at Y and Z.
+func (m *roiMask) row(y, z int) []xRange {
+	return m.rows[[2]int{z / m.blockSize, y / m.blockSize}]
+}
+
+// intersects returns true if any voxel within x0 <= x < x1, y0 <= y < y1, and
+// z0 <= z < z1 is in the ROI.
+func (m *roiMask) intersects(x0, x1, y0, y1, z0, z1 int) bool {
+	for bz := z0 / m.blockSize; bz <= (z1-1)/m.blockSize; bz++ {
+		for by := y0 / m.blockSize; by <= (y1-1)/m.blockSize; by++ {
+			for _, r := range m.rows[[2]int{bz, by}] {
+				if r.x0 < x1 && r.x1 > x0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
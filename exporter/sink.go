@@ -0,0 +1,370 @@
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	lz4 "github.com/janelia-flyem/go/golz4"
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// Slab is a block of body labels ready for output.  Data holds the uncompressed
+// labels as little-endian uint64 in X, then Y, then Z order.  Slabs on the edge of
+// the volume are zero-padded to the full size.
+type Slab struct {
+	Data   []byte
+	Origin [3]int // voxel coordinate of the first label in Data
+	Size   [3]int // size along X, Y, and Z in voxels
+
+	// Voxels within ValidMin <= v < ValidMax come from superpixel images.  The rest
+	// of the slab is padding past the edge of the images or slices without images.
+	ValidMin [3]int
+	ValidMax [3]int
+}
+
+// Sink is a destination for label slabs.  An export may call WriteSlab from several
+// goroutines at once, and slabs of a layer may arrive in any order.
+type Sink interface {
+	WriteSlab(slab Slab) error
+}
+
+// ErrSkipped is returned by WriteSlab when a sink kept an existing slab instead of
+// writing it, so the export doesn't record the slab as written.
+var ErrSkipped = errors.New("slab skipped")
+
+// MultiSink fans out each slab to all of its sinks in order, stopping at the first error.
+// If a sink skips the slab, the rest still get it and ErrSkipped is returned.
+type MultiSink []Sink
+
+func (ms MultiSink) WriteSlab(slab Slab) error {
+	var skipped bool
+	for _, s := range ms {
+		err := s.WriteSlab(slab)
+		if err == ErrSkipped {
+			skipped = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if skipped {
+		return ErrSkipped
+	}
+	return nil
+}
+
+// MemorySink keeps all written slabs in memory.  It is mainly useful for testing.
+type MemorySink struct {
+	sync.Mutex
+	Slabs []Slab
+}
+
+func (ms *MemorySink) WriteSlab(slab Slab) error {
+	data := make([]byte, len(slab.Data))
+	copy(data, slab.Data)
+	slab.Data = data
+
+	ms.Lock()
+	ms.Slabs = append(ms.Slabs, slab)
+	ms.Unlock()
+	return nil
+}
+
+// DVIDSink POSTs each slab to the raw endpoint of a DVID labels instance, or with
+// ProtocolBlocks, as compressed blocks of BlockSize^3 voxels to the blocks endpoint
+// of a labelarray or labelmap instance.  If Check is set, each slab is read back
+// after it is POSTed, any differences are recorded in the check, and a slab that
+// differs is an error.
+type DVIDSink struct {
+	URL         string // e.g., "http://dvidserver.com/api/653/dataname"
+	Compression string
+	DryRun      bool
+	Check       *DVIDCheck
+	Client      *DVIDClient
+
+	Protocol  string // ProtocolRaw if empty
+	BlockSize int    // size of blocks for ProtocolBlocks
+
+	// Labels are supervoxel ids, so they are read back from a labelmap with
+	// supervoxels=true rather than as mapped bodies.
+	Supervoxels bool
+}
+
+// NewDVIDSink returns a sink that POSTs to the given DVID data URL with a client
+// using the default timeout and retries.
+func NewDVIDSink(url, compression string, dryrun bool) *DVIDSink {
+	client := DefaultOptions().DVIDClient()
+	return &DVIDSink{URL: url, Compression: compression, DryRun: dryrun, Client: client}
+}
+
+func (ds *DVIDSink) WriteSlab(slab Slab) error {
+	if ds.Protocol == ProtocolBlocks {
+		if err := ds.postBlocks(slab); err != nil || ds.DryRun || ds.Check == nil {
+			return err
+		}
+		return ds.readBack(slab)
+	}
+
+	url := ds.rawURL(slab) + "?throttle=on"
+	switch ds.Compression {
+	case "gzip", "lz4":
+		url += "&compression=" + ds.Compression
+	}
+
+	out, err := compress(slab.Data, ds.Compression)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Attempting to POST %d bytes to %s\n", len(out), url)
+	if ds.DryRun {
+		return nil
+	}
+
+	if _, err := ds.Client.Do("POST", url, out); err != nil {
+		return err
+	}
+	fmt.Printf("POSTed successfully %d bytes to %s\n", len(out), url)
+	if ds.Check != nil {
+		return ds.readBack(slab)
+	}
+	return nil
+}
+
+// instanceType returns the type name of the sink's data instance, e.g., "labelmap".
+func (ds *DVIDSink) instanceType() (string, error) {
+	data, err := ds.Client.Do("GET", ds.URL+"/info", nil)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Base struct {
+			TypeName string
+		}
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", fmt.Errorf("Unable to parse DVID instance info from %s/info: %s", ds.URL, err.Error())
+	}
+	return info.Base.TypeName, nil
+}
+
+// Policies for slab files that already exist in a FileSink directory.
+const (
+	OverwriteAlways = "overwrite"      // replace existing files
+	OverwriteSkip   = "skip-existing"  // keep existing files and don't write the slab
+	OverwriteFail   = "fail-if-exists" // fail the export at the first existing file
+)
+
+// FileSink writes each slab to a separate file in a directory.  Each file is written
+// to a temporary file in the same directory, synced, and renamed into place, so a
+// killed export never leaves a truncated slab under its final name.  If Sidecars is
+// set, a JSON slabs.Metadata file is put in place before each slab file, so a killed
+// export may leave a sidecar that doesn't match the slab file, which slabs.Read
+// detects, but never an old sidecar that looks like it describes a new slab.  Slabs
+// kept under the OverwriteSkip policy return ErrSkipped.
+type FileSink struct {
+	Dir         string
+	Compression string
+	DryRun      bool
+	Overwrite   string // OverwriteAlways if empty
+
+	Sidecars    bool
+	BodyOffset  int           // body offset recorded in sidecars
+	Supervoxels bool          // whether labels are supervoxels, recorded in sidecars
+	Session     slabs.Session // source session recorded in sidecars
+}
+
+// NewFileSink returns a sink that writes slab files into the given directory,
+// creating the directory if necessary.
+func NewFileSink(dir, compression string, dryrun bool) (*FileSink, error) {
+	if fileinfo, err := os.Stat(dir); os.IsNotExist(err) {
+		fmt.Printf("Creating output directory: %s\n", dir)
+		err := os.MkdirAll(dir, 0744)
+		if err != nil {
+			return nil, fmt.Errorf("Can't make output directory: %s\n", err.Error())
+		}
+	} else if !fileinfo.IsDir() {
+		return nil, fmt.Errorf("Supplied output path (%s) is not a directory.", dir)
+	}
+	return &FileSink{Dir: dir, Compression: compression, DryRun: dryrun}, nil
+}
+
+func (fs *FileSink) WriteSlab(slab Slab) error {
+	// Compute the output file name
+	base, err := slabs.Name(slab.Size, slab.Origin, fs.Compression)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(fs.Dir, base)
+
+	// Check for an existing file before doing any work.
+	switch fs.Overwrite {
+	case OverwriteSkip, OverwriteFail:
+		if _, err := os.Lstat(filename); err == nil {
+			if fs.Overwrite == OverwriteFail {
+				return fmt.Errorf("Output file %s already exists", filename)
+			}
+			fmt.Printf("Skipping existing file %s\n", filename)
+			return ErrSkipped
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	fmt.Printf("Writing data to %s\n", filename)
+	if fs.DryRun {
+		return nil
+	}
+
+	// Compress and write
+	out, err := compress(slab.Data, fs.Compression)
+	if err != nil {
+		return err
+	}
+	if fs.Sidecars {
+		if err := fs.writeSidecar(filename, slab, out); err != nil {
+			return err
+		}
+	}
+	written, err := fs.writeFile(filename, out)
+	if err != nil || !written {
+		// Don't leave the new sidecar next to a slab file it doesn't describe.
+		if fs.Sidecars {
+			os.Remove(filename + slabs.SidecarExt)
+		}
+		if err == nil {
+			err = ErrSkipped
+		}
+		return err
+	}
+	return syncDir(fs.Dir)
+}
+
+// writeSidecar describes a slab in a sidecar for the slab file, replacing any left by
+// an earlier export, and syncs the directory so the sidecar is in place before the
+// slab file.
+func (fs *FileSink) writeSidecar(filename string, slab Slab, out []byte) error {
+	md := newSlabMetadata(slab, fs.Compression, out)
+	md.BodyOffset = fs.BodyOffset
+	md.Supervoxels = fs.Supervoxels
+	md.Session = fs.Session
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpname, err := fs.writeTemp(filename+slabs.SidecarExt, append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpname, filename+slabs.SidecarExt); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return syncDir(fs.Dir)
+}
+
+// syncDir syncs a directory so the files renamed or linked into it survive a crash
+// before the slab is recorded as written.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to sync output directory %s: %s", dir, err.Error())
+	}
+	return nil
+}
+
+// writeTemp writes data to a synced temporary file in the directory of filename and
+// returns the temporary file's name.
+func (fs *FileSink) writeTemp(filename string, data []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	tmpname := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpname, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return "", err
+	}
+	return tmpname, nil
+}
+
+// writeFile atomically creates or replaces a file with the given data according to
+// the overwrite policy.  It returns false if an existing file was kept.
+func (fs *FileSink) writeFile(filename string, data []byte) (bool, error) {
+	tmpname, err := fs.writeTemp(filename, data)
+	if err != nil {
+		return false, err
+	}
+
+	switch fs.Overwrite {
+	case OverwriteSkip, OverwriteFail:
+		// Linking fails if another writer created the file since it was checked.
+		err = os.Link(tmpname, filename)
+		os.Remove(tmpname)
+		if os.IsExist(err) {
+			if fs.Overwrite == OverwriteFail {
+				return false, fmt.Errorf("Output file %s already exists", filename)
+			}
+			fmt.Printf("Skipping existing file %s\n", filename)
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		if err := os.Rename(tmpname, filename); err != nil {
+			os.Remove(tmpname)
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+func compress(slabBuf []byte, compression string) ([]byte, error) {
+	switch compression {
+
+	case "none":
+		return slabBuf, nil
+
+	case "lz4":
+		compressed := make([]byte, lz4.CompressBound(slabBuf))
+		outsize, err := lz4.Compress(slabBuf, compressed)
+		if err != nil {
+			return nil, err
+		}
+		return compressed[:outsize], nil
+
+	case "gzip":
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(slabBuf); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression type %q", compression)
+	}
+}
@@ -0,0 +1,181 @@
+package exporter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// readSlabFile returns the contents of a slab file and its sidecar.
+func readSlabFile(t *testing.T, fs *FileSink, slab Slab) (data, sidecar []byte) {
+	base, err := slabs.Name(slab.Size, slab.Origin, fs.Compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(fs.Dir, base)
+	if data, err = os.ReadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar, err = os.ReadFile(filename + slabs.SidecarExt); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return data, sidecar
+}
+
+// TestOverwritePolicies checks each policy for a slab file that already exists.
+func TestOverwritePolicies(t *testing.T) {
+	origin, size := [3]int{8, 4, 2}, [3]int{8, 4, 2}
+	old := testSlab(origin, size)
+	new := testSlab(origin, size)
+	new.Data[0]++
+
+	for _, policy := range []string{OverwriteAlways, OverwriteSkip, OverwriteFail} {
+		fs, err := NewFileSink(t.TempDir(), "gzip", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.Sidecars = true
+		if err := fs.WriteSlab(old); err != nil {
+			t.Fatal(err)
+		}
+		oldData, oldSidecar := readSlabFile(t, fs, old)
+
+		fs.Overwrite = policy
+		err = fs.WriteSlab(new)
+		data, sidecar := readSlabFile(t, fs, new)
+		switch policy {
+		case OverwriteAlways:
+			if err != nil {
+				t.Fatalf("%s: %v", policy, err)
+			}
+			sf, err := slabs.Read(filepath.Join(fs.Dir, mustSlabName(t, new, fs.Compression)))
+			if err != nil {
+				t.Fatalf("%s: %v", policy, err)
+			}
+			if sf.Labels[0] != slabLabels(new)[0] {
+				t.Errorf("%s: slab file wasn't replaced", policy)
+			}
+		case OverwriteSkip:
+			if err != ErrSkipped {
+				t.Errorf("%s: expected ErrSkipped, got %v", policy, err)
+			}
+		case OverwriteFail:
+			if err == nil || !strings.Contains(err.Error(), "already exists") {
+				t.Errorf("%s: expected an error for the existing file, got %v", policy, err)
+			}
+		}
+		if policy != OverwriteAlways && (!bytes.Equal(data, oldData) || !bytes.Equal(sidecar, oldSidecar)) {
+			t.Errorf("%s: existing slab file or sidecar was changed", policy)
+		}
+		entries, err := os.ReadDir(fs.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("%s: expected only the slab file and its sidecar, found %d files", policy, len(entries))
+		}
+	}
+}
+
+func mustSlabName(t *testing.T, slab Slab, compression string) string {
+	name, err := slabs.Name(slab.Size, slab.Origin, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// TestMultiSinkSkipped checks that a slab skipped by one sink still goes to the others.
+func TestMultiSinkSkipped(t *testing.T) {
+	fs, err := NewFileSink(t.TempDir(), "none", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slab := testSlab([3]int{0, 0, 0}, [3]int{8, 4, 2})
+	if err := fs.WriteSlab(slab); err != nil {
+		t.Fatal(err)
+	}
+	fs.Overwrite = OverwriteSkip
+	var ms MemorySink
+	if err := (MultiSink{fs, &ms}).WriteSlab(slab); err != ErrSkipped {
+		t.Fatalf("expected ErrSkipped, got %v", err)
+	}
+	if len(ms.Slabs) != 1 {
+		t.Fatalf("slab skipped by the file sink wasn't sent to the next sink")
+	}
+}
+
+// TestSkipExistingNotRecorded checks that an export with -overwrite=skip-existing
+// doesn't record slabs it kept in the progress manifest, and doesn't change them.
+func TestSkipExistingNotRecorded(t *testing.T) {
+	dir := t.TempDir()
+	opts := sequential(writeTestSession(t, dir))
+	opts.OutDir = filepath.Join(dir, "out")
+	opts.Compression = "gzip"
+	runExport(t, opts)
+	before := readDir(t, opts.OutDir)
+
+	// Change the mapping, so kept slabs hold different bodies than the export would.
+	opts.BodyOffset = 1000
+	opts.Overwrite = OverwriteSkip
+	runExport(t, opts)
+	m, err := LoadManifest(opts.ManifestFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 0 {
+		t.Errorf("%d kept slabs recorded as written", len(m.Entries))
+	}
+	after := readDir(t, opts.OutDir)
+	if len(after) != len(before) {
+		t.Fatalf("%d files before export with skip-existing, %d after", len(before), len(after))
+	}
+	for name, data := range before {
+		if !bytes.Equal(after[name], data) {
+			t.Errorf("%s was changed by export with skip-existing", name)
+		}
+	}
+
+	opts.Overwrite = OverwriteFail
+	if err := newExporter(t, opts).Run(); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected export with fail-if-exists to fail, got %v", err)
+	}
+}
+
+// runExport runs an export to the outputs given in the options.
+func runExport(t *testing.T, opts Options) {
+	t.Helper()
+	if err := newExporter(t, opts).Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newExporter(t *testing.T, opts Options) *Exporter {
+	t.Helper()
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// readDir returns the contents of each file in a directory.
+func readDir(t *testing.T, dir string) map[string][]byte {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	return files
+}
@@ -0,0 +1,205 @@
+package exporter
+
+import (
+	"fmt"
+	"image"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Plane is a superpixel image for one Z slice.
+type Plane struct {
+	Z      int
+	Image  image.Image
+	Format SuperpixelFormat
+	Name   string // description of the plane's origin for logging, e.g., a filename
+}
+
+// NewPlane returns a plane for a superpixel image, determining the superpixel format
+// from the image type.
+func NewPlane(z int, img image.Image, name string) (Plane, error) {
+	var format SuperpixelFormat
+	switch typedImg := img.(type) {
+	case *image.Gray16:
+		format = Superpixel16Bits
+	case *image.RGBA, *image.NRGBA:
+		format = Superpixel24Bits
+	default:
+		return Plane{}, fmt.Errorf("Unable to decode superpixel image of type %T", typedImg)
+	}
+	return Plane{Z: z, Image: img, Format: format, Name: name}, nil
+}
+
+// Source provides superpixel planes for an export.
+type Source interface {
+	// Walk calls fn for each plane with minz <= Z <= maxz.  Planes must be given
+	// in increasing Z order, and Walk stops at the first error returned by fn.
+	Walk(minz, maxz int, fn func(Plane) error) error
+}
+
+// PNGDirSource reads Raveler superpixel PNG images, e.g., "superpixel_map.00123.png",
+// from a directory.  The Z slice is the number just before the file extension.
+type PNGDirSource struct {
+	Dir string
+
+	// Number of images decoded concurrently.  Up to Workers images ahead of the one
+	// being processed are held in memory.
+	Workers int
+}
+
+// NewPNGDirSource returns a source for a Raveler superpixel image directory that
+// decodes one image at a time.
+func NewPNGDirSource(dir string) *PNGDirSource {
+	return &PNGDirSource{Dir: dir, Workers: 1}
+}
+
+var pngSliceRegex = regexp.MustCompile(`[[:digit:]]+\.png$`)
+
+// PNGSliceZ parses the Z slice from a superpixel PNG filename.
+func PNGSliceZ(fullpath string) (int, error) {
+	rfrag := pngSliceRegex.FindString(fullpath) // gets everything from number through end of extension.
+	if len(rfrag) < 5 {
+		return 0, fmt.Errorf("error parsing Z slice in filename %q", fullpath)
+	}
+	rfrag = rfrag[:len(rfrag)-4]
+	z, err := strconv.Atoi(rfrag)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing Z in filename %q: %s", fullpath, err.Error())
+	}
+	return z, nil
+}
+
+type pngFile struct {
+	path string
+	z    int
+}
+
+// files returns the superpixel images with minz <= Z <= maxz in increasing Z order.
+// It is an error for two images to have the same Z, e.g., "sp.7.png" and "sp.007.png".
+func (src *PNGDirSource) files(minz, maxz int) ([]pngFile, error) {
+	var files []pngFile
+	err := filepath.Walk(src.Dir, func(fullpath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("Error traversing the superpixel image directory @ %s: %s", fullpath, err.Error())
+		}
+
+		ext := filepath.Ext(fullpath)
+		if ext != ".png" {
+			fmt.Printf("Skipping transformation of non-PNG file: %s\n", fullpath)
+			return nil
+		}
+
+		z, err := PNGSliceZ(fullpath)
+		if err != nil {
+			return err
+		}
+
+		// Skip files that aren't within our processing range.
+		if z < minz || z > maxz {
+			return nil
+		}
+		files = append(files, pngFile{fullpath, z})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].z < files[j].z })
+	for i := 1; i < len(files); i++ {
+		if files[i].z == files[i-1].z {
+			return nil, fmt.Errorf("superpixel images %q and %q are both for Z slice %d", files[i-1].path, files[i].path, files[i].z)
+		}
+	}
+	return files, nil
+}
+
+// Zs returns the Z slices of the superpixel images with minz <= Z <= maxz in the
+// order they are processed.
+func (src *PNGDirSource) Zs(minz, maxz int) ([]int, error) {
+	files, err := src.files(minz, maxz)
+	if err != nil {
+		return nil, err
+	}
+	zs := make([]int, len(files))
+	for i, f := range files {
+		zs[i] = f.z
+	}
+	return zs, nil
+}
+
+type planeResult struct {
+	plane Plane
+	err   error
+}
+
+func (src *PNGDirSource) Walk(minz, maxz int, fn func(Plane) error) error {
+	files, err := src.files(minz, maxz)
+	if err != nil {
+		return err
+	}
+	if src.Workers <= 1 {
+		for _, f := range files {
+			plane, err := readPNGPlane(f.path, f.z)
+			if err != nil {
+				return err
+			}
+			if err := fn(plane); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Decode images concurrently but hand them to fn in order.  Each image gets a
+	// result channel that is queued in order, and the queue's capacity bounds the
+	// number of images decoded ahead.
+	pending := make(chan chan planeResult, src.Workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(pending)
+		for _, f := range files {
+			result := make(chan planeResult, 1)
+			select {
+			case pending <- result:
+			case <-done:
+				return
+			}
+			go func(f pngFile) {
+				plane, err := readPNGPlane(f.path, f.z)
+				result <- planeResult{plane, err}
+			}(f)
+		}
+	}()
+	for result := range pending {
+		r := <-result
+		if r.err != nil {
+			return r.err
+		}
+		if err := fn(r.plane); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPNGPlane(fullpath string, z int) (Plane, error) {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return Plane{}, fmt.Errorf("Unable to open superpixel image %q", fullpath)
+	}
+	defer file.Close()
+
+	img, iformat, err := image.Decode(file)
+	if err != nil {
+		return Plane{}, fmt.Errorf("Unable to decode superpixel image %q: %s", fullpath, err.Error())
+	}
+	if iformat != "png" {
+		return Plane{}, fmt.Errorf("superpixel image was not PNG formatted")
+	}
+	return NewPlane(z, img, filepath.Base(fullpath))
+}
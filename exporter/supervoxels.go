@@ -0,0 +1,225 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SupervoxelID returns the globally unique supervoxel id written for a superpixel
+// when exporting supervoxels: slice << 24 | label.
+func SupervoxelID(sp Superpixel) uint64 {
+	return uint64(sp.Slice)<<24 | uint64(sp.Label)
+}
+
+// BodyMapping is a body and the supervoxels mapped to it.
+type BodyMapping struct {
+	Body        uint64
+	Supervoxels []uint64
+}
+
+// supervoxelMappings returns the body of each supervoxel in the range of slices
+// processed, as recorded in the unmapped report, grouped by body in increasing order,
+// and the number of supervoxels left without a mapping because their superpixels are
+// mapped to body 0.  Bodies include the body offset.  Unmapped superpixels are mapped
+// to their unmapped body from the report.
+func (opts Options) supervoxelMappings(sp2body *BodyTable, unmapped *UnmappedReport) ([]BodyMapping, int) {
+	svs := make(map[uint64][]uint64)
+	var nzero int
+	for _, z := range sp2body.Zs() {
+		if unmapped.minz < 0 || int(z) < unmapped.minz || int(z) > unmapped.maxz {
+			continue
+		}
+		slice := sp2body.Slice(z)
+		for _, label := range slice.Labels() {
+			body, _ := slice.Body(label)
+			if label == 0 {
+				continue
+			}
+			if body == 0 {
+				nzero++
+				continue
+			}
+			body += uint64(opts.BodyOffset)
+			svs[body] = append(svs[body], SupervoxelID(Superpixel{z, label}))
+		}
+	}
+	for _, us := range unmapped.Slices {
+		for _, sp := range us.Superpixels {
+			if sp.Body != 0 {
+				svs[sp.Body] = append(svs[sp.Body], SupervoxelID(Superpixel{uint32(us.Z), sp.Label}))
+			}
+		}
+	}
+
+	mappings := make([]BodyMapping, 0, len(svs))
+	for body, ids := range svs {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		mappings = append(mappings, BodyMapping{body, ids})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Body < mappings[j].Body })
+	return mappings, nzero
+}
+
+// checkBodyCollisions warns about bodies whose ids are also supervoxel ids, since
+// DVID would treat them as the same label.
+func checkBodyCollisions(mappings []BodyMapping) {
+	svs := make(map[uint64]bool)
+	for _, m := range mappings {
+		for _, sv := range m.Supervoxels {
+			svs[sv] = true
+		}
+	}
+	var n int
+	for _, m := range mappings {
+		if svs[m.Body] && !(len(m.Supervoxels) == 1 && m.Supervoxels[0] == m.Body) {
+			n++
+		}
+	}
+	if n != 0 {
+		fmt.Printf("WARNING: %d bodies have the id of another supervoxel.  Use -bodyoffset to move bodies above the supervoxel ids.\n", n)
+	}
+}
+
+// WriteMappingFile writes each supervoxel and its body as a line of text.
+func WriteMappingFile(mappings []BodyMapping, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range mappings {
+		for _, sv := range m.Supervoxels {
+			fmt.Fprintf(w, "%d %d\n", sv, m.Body)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodeMappingOps encodes mappings as a DVID MappingOps protobuf message:
+//
+//	message MappingOp {
+//	    uint64 mutid = 1;
+//	    uint64 mapped = 2;
+//	    repeated uint64 original = 3;
+//	}
+//	message MappingOps {
+//	    repeated MappingOp mappings = 1;
+//	}
+func encodeMappingOps(mappings []BodyMapping) []byte {
+	var out, op, packed []byte
+	for _, m := range mappings {
+		packed = packed[:0]
+		for _, sv := range m.Supervoxels {
+			packed = appendUvarint(packed, sv)
+		}
+		op = op[:0]
+		op = append(op, 2<<3|0) // mapped, varint
+		op = appendUvarint(op, m.Body)
+		op = append(op, 3<<3|2) // original, packed
+		op = appendUvarint(op, uint64(len(packed)))
+		op = append(op, packed...)
+
+		out = append(out, 1<<3|2) // mappings, length-delimited
+		out = appendUvarint(out, uint64(len(op)))
+		out = append(out, op...)
+	}
+	return out
+}
+
+// appendUvarint appends the protobuf varint encoding of v.
+func appendUvarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// maxMappingsPerPost is the most supervoxels sent in one POST of mappings.
+const maxMappingsPerPost = 1 << 20
+
+// PostMappings sends supervoxel->body mappings to the mappings endpoint of a DVID
+// labelmap instance in batches.
+func (ds *DVIDSink) PostMappings(mappings []BodyMapping) error {
+	url := ds.URL + "/mappings"
+	for len(mappings) != 0 {
+		var n, svs int
+		for n < len(mappings) && (n == 0 || svs+len(mappings[n].Supervoxels) <= maxMappingsPerPost) {
+			svs += len(mappings[n].Supervoxels)
+			n++
+		}
+		body := encodeMappingOps(mappings[:n])
+		fmt.Printf("Attempting to POST mappings of %d supervoxels to %d bodies in %d bytes to %s\n", svs, n, len(body), url)
+		if !ds.DryRun {
+			if _, err := ds.Client.Do("POST", url, body); err != nil {
+				return err
+			}
+		}
+		mappings = mappings[n:]
+	}
+	return nil
+}
+
+// checkLabelmap returns an error unless the sink's data instance is a labelmap, the
+// only labels type with a mappings endpoint.
+func (ds *DVIDSink) checkLabelmap() error {
+	typename, err := ds.instanceType()
+	if err != nil {
+		return err
+	}
+	if typename != "labelmap" {
+		return fmt.Errorf("supervoxels can only be exported to a labelmap instance, but %s is %q", ds.URL, typename)
+	}
+	return nil
+}
+
+// checkLabelmaps checks that each DVID output of a supervoxel export is a labelmap,
+// so an export that couldn't send its mappings fails before writing any slabs.
+func (e *Exporter) checkLabelmaps() error {
+	for _, ds := range dvidSinks(e.sink) {
+		if ds.DryRun {
+			continue
+		}
+		if err := ds.checkLabelmap(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMappings sends the supervoxel->body mappings of a supervoxel export to each
+// DVID output and writes them to the output directory.
+func (e *Exporter) writeMappings(sp2body *BodyTable, unmapped *UnmappedReport) error {
+	if unmapped.minz < 0 {
+		return nil // no slices processed
+	}
+	tlog := NewTimeLog()
+	mappings, nzero := e.opts.supervoxelMappings(sp2body, unmapped)
+	checkBodyCollisions(mappings)
+	if nzero != 0 {
+		fmt.Printf("%d supervoxels of superpixels mapped to body 0 have no mapping, so DVID treats each as its own body\n", nzero)
+	}
+	for _, ds := range dvidSinks(e.sink) {
+		if err := ds.PostMappings(mappings); err != nil {
+			return err
+		}
+	}
+	if e.opts.OutDir != "" && !e.opts.DryRun {
+		// Name the file for the slices processed, like the unmapped report, so jobs
+		// with defaulted or overlapping Z ranges don't write the same file.
+		filename := filepath.Join(e.opts.OutDir, fmt.Sprintf("supervoxel-bodies-z%d-%d.txt", unmapped.minz, unmapped.maxz))
+		if err := WriteMappingFile(mappings, filename); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote supervoxel->body mapping to %s\n", filename)
+	}
+	tlog.Printf("Wrote mappings for %d bodies", len(mappings))
+	return nil
+}
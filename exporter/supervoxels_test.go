@@ -0,0 +1,191 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestExportSupervoxels checks that a supervoxel export writes the supervoxel id of
+// every nonzero superpixel, including those of body 0, and maps all but the body 0
+// superpixels.
+func TestExportSupervoxels(t *testing.T) {
+	dir := t.TempDir()
+	opts := sequential(writeTestSession(t, dir))
+
+	// Map every fifth superpixel's segment to body 0.
+	var seg2body strings.Builder
+	for z := testMinZ; z <= testMaxZ; z++ {
+		for label := 1; label <= 400; label++ {
+			if label%37 == 0 {
+				continue
+			}
+			segment := z*1000 + label
+			body := 1 + segment%53
+			if label%5 == 0 {
+				body = 0
+			}
+			fmt.Fprintf(&seg2body, "%d %d\n", segment, body)
+		}
+	}
+	writeTestFile(t, opts.SegmentToBody, []byte(seg2body.String()))
+
+	opts.Supervoxels = true
+	opts.BodyOffset = 1 << 40
+	opts.Unmapped = UnmappedUnique
+	opts.UnmappedBody = 1 << 50
+	opts.OutDir = filepath.Join(dir, "out")
+	if err := os.Mkdir(opts.OutDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, slab := range exportSlabs(t, opts) {
+		nx, ny := slab.Size[0], slab.Size[1]
+		for i, got := range slabLabels(slab) {
+			x, y, z := slab.Origin[0]+i%nx, slab.Origin[1]+(i/nx)%ny, slab.Origin[2]+i/(nx*ny)
+			var want uint64
+			if x < testWidth && y < testHeight && z >= testMinZ && z <= testMaxZ {
+				if label := testLabel(x, y, z); label != 0 {
+					want = SupervoxelID(Superpixel{uint32(z), label})
+				}
+			}
+			if got != want {
+				t.Fatalf("voxel (%d,%d,%d) is %d, expected %d", x, y, z, got, want)
+			}
+		}
+	}
+
+	table, err := opts.BodyTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	report := newUnmappedReport(opts.Unmapped)
+	report.minz, report.maxz = testMinZ, testMaxZ
+	if _, nzero := opts.supervoxelMappings(table, report); nzero != 78*(testMaxZ-testMinZ+1) {
+		t.Errorf("counted %d supervoxels of body 0, expected %d", nzero, 78*(testMaxZ-testMinZ+1))
+	}
+
+	mapped := readMappingFile(t, filepath.Join(opts.OutDir, fmt.Sprintf("supervoxel-bodies-z%d-%d.txt", testMinZ, testMaxZ)))
+	// Unmapped superpixels are only known, and mapped, if they appear in an image.
+	present := make(map[uint64]bool)
+	for z := testMinZ; z <= testMaxZ; z++ {
+		for y := 0; y < testHeight; y++ {
+			for x := 0; x < testWidth; x++ {
+				present[SupervoxelID(Superpixel{uint32(z), testLabel(x, y, z)})] = true
+			}
+		}
+	}
+	for z := testMinZ; z <= testMaxZ; z++ {
+		for label := uint32(1); label <= 400; label++ {
+			sv := SupervoxelID(Superpixel{uint32(z), label})
+			body, found := mapped[sv]
+			switch {
+			case label%37 == 0:
+				if present[sv] != found || found && body != opts.UnmappedBody+sv {
+					t.Fatalf("unmapped supervoxel %d mapped to %d, expected %d", sv, body, opts.UnmappedBody+sv)
+				}
+			case label%5 == 0:
+				if found {
+					t.Fatalf("supervoxel %d of body 0 mapped to %d", sv, body)
+				}
+			default:
+				if want := uint64(opts.BodyOffset + 1 + (z*1000+int(label))%53); body != want {
+					t.Fatalf("supervoxel %d mapped to %d, expected %d", sv, body, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSupervoxelJobMappings checks that a job's mapping file is named for, and only
+// maps, the slices the job processed, even if its Z range extends past them.
+func TestSupervoxelJobMappings(t *testing.T) {
+	dir := t.TempDir()
+	opts := sequential(writeTestSession(t, dir))
+	opts.Supervoxels = true
+	opts.Unmapped = UnmappedSentinel
+	opts.UnmappedBody = 1 << 50
+	opts.OutDir = filepath.Join(dir, "out")
+	if err := os.Mkdir(opts.OutDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts.MinZ, opts.MaxZ = 0, 10
+	exportSlabs(t, opts)
+	opts.MinZ, opts.MaxZ = 11, DefaultOptions().MaxZ
+	exportSlabs(t, opts)
+
+	for _, job := range [][2]int{{testMinZ, 10}, {11, testMaxZ}} {
+		mapped := readMappingFile(t, filepath.Join(opts.OutDir, fmt.Sprintf("supervoxel-bodies-z%d-%d.txt", job[0], job[1])))
+		if len(mapped) == 0 {
+			t.Fatalf("no mappings for slices %d to %d", job[0], job[1])
+		}
+		for sv := range mapped {
+			if z := int(sv >> 24); z < job[0] || z > job[1] {
+				t.Fatalf("mappings for slices %d to %d include supervoxel %d of slice %d", job[0], job[1], sv, z)
+			}
+		}
+	}
+}
+
+// readMappingFile returns the supervoxel->body mappings in a mapping file.
+func readMappingFile(t *testing.T, filename string) map[uint64]uint64 {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mapped := make(map[uint64]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var sv, body uint64
+		if _, err := fmt.Sscan(scanner.Text(), &sv, &body); err != nil {
+			t.Fatal(err)
+		}
+		mapped[sv] = body
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return mapped
+}
+
+// TestSupervoxelsNeedLabelmap checks that a supervoxel export to DVID fails before
+// writing any slabs unless the instance is a labelmap.
+func TestSupervoxelsNeedLabelmap(t *testing.T) {
+	opts := sequential(writeTestSession(t, t.TempDir()))
+	opts.Supervoxels = true
+	if err := opts.Validate(); err == nil {
+		t.Errorf("supervoxel export with unmapped superpixels written as 0 was allowed")
+	}
+	opts.Unmapped = UnmappedSentinel
+	opts.UnmappedBody = 1 << 50
+
+	for _, typename := range []string{"labelblk", "labelarray", "labelmap"} {
+		d, server := newTestDVID(t)
+		url := server.URL + "/api/node/abc/seg"
+		d.volumes["/api/node/abc/seg/info"] = []byte(`{"Base":{"TypeName":"` + typename + `","Name":"seg"},"Extended":{}}`)
+		e, err := NewWithSink(opts, &DVIDSink{URL: url, Compression: "none", Client: testDVIDClient()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.Run()
+		if typename == "labelmap" {
+			if err != nil {
+				t.Fatalf("export to labelmap failed: %v", err)
+			}
+			if _, found := d.volumes["/api/node/abc/seg/mappings"]; !found {
+				t.Fatalf("no mappings POSTed to labelmap")
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "labelmap") {
+			t.Fatalf("expected export to %s to fail, got %v", typename, err)
+		}
+		if len(d.volumes) != 1 {
+			t.Fatalf("%d slabs POSTed to %s before failing", len(d.volumes)-1, typename)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Policies for superpixels in the images that aren't in the superpixel->body mapping.
+const (
+	UnmappedZero     = "zero"     // label them as body 0
+	UnmappedFail     = "fail"     // fail the export after the first slice with unmapped superpixels
+	UnmappedSentinel = "sentinel" // label them all as Options.UnmappedBody
+	UnmappedUnique   = "unique"   // give each its own body, Options.UnmappedBody + (slice << 24 | label)
+)
+
+// UnmappedSuperpixel is a superpixel without a mapping and the number of voxels it covers.
+type UnmappedSuperpixel struct {
+	Label  uint32 `json:"label"`
+	Voxels int    `json:"voxels"`
+	Body   uint64 `json:"body"` // body written for the superpixel
+}
+
+// UnmappedSlice lists the unmapped superpixels of one slice.
+type UnmappedSlice struct {
+	Z           int                  `json:"z"`
+	Image       string               `json:"image"`
+	Voxels      int                  `json:"voxels"`
+	Superpixels []UnmappedSuperpixel `json:"superpixels"`
+}
+
+// UnmappedReport summarizes the unmapped superpixels found during an export.
+type UnmappedReport struct {
+	Policy         string          `json:"policy"`
+	NumSuperpixels int             `json:"num_superpixels"`
+	NumVoxels      int             `json:"num_voxels"`
+	Slices         []UnmappedSlice `json:"slices"`
+
+	minz, maxz int // range of slices processed
+}
+
+func newUnmappedReport(policy string) *UnmappedReport {
+	return &UnmappedReport{Policy: policy, Slices: []UnmappedSlice{}, minz: -1}
+}
+
+// unmappedBody returns the body for a superpixel that isn't in the mapping.
+func (opts Options) unmappedBody(sp Superpixel) uint64 {
+	switch opts.Unmapped {
+	case UnmappedSentinel:
+		return opts.UnmappedBody
+	case UnmappedUnique:
+		return opts.UnmappedBody + (uint64(sp.Slice)<<24 | uint64(sp.Label))
+	default:
+		return 0
+	}
+}
+
+// addSlice records the voxel counts of a slice's unmapped superpixels and logs them.
+func (r *UnmappedReport) addSlice(plane Plane, counts map[uint32]int, opts Options) {
+	if r.minz < 0 || plane.Z < r.minz {
+		r.minz = plane.Z
+	}
+	if plane.Z > r.maxz {
+		r.maxz = plane.Z
+	}
+	if len(counts) == 0 {
+		return
+	}
+	us := UnmappedSlice{Z: plane.Z, Image: plane.Name}
+	for label, voxels := range counts {
+		body := opts.unmappedBody(Superpixel{uint32(plane.Z), label})
+		us.Superpixels = append(us.Superpixels, UnmappedSuperpixel{label, voxels, body})
+		us.Voxels += voxels
+	}
+	sort.Slice(us.Superpixels, func(i, j int) bool { return us.Superpixels[i].Label < us.Superpixels[j].Label })
+	r.Slices = append(r.Slices, us)
+	r.NumSuperpixels += len(us.Superpixels)
+	r.NumVoxels += us.Voxels
+
+	const maxListed = 10
+	var ids []string
+	for i, sp := range us.Superpixels {
+		if i == maxListed {
+			ids = append(ids, fmt.Sprintf("... %d more", len(us.Superpixels)-maxListed))
+			break
+		}
+		ids = append(ids, fmt.Sprintf("%d (%d voxels)", sp.Label, sp.Voxels))
+	}
+	fmt.Printf("Slice %d has %d unmapped superpixels covering %d voxels, written as %s: %s\n",
+		plane.Z, len(us.Superpixels), us.Voxels, opts.Unmapped, strings.Join(ids, ", "))
+}
+
+// Filename returns the name of the report file for the range of slices processed.
+func (r *UnmappedReport) Filename() string {
+	return fmt.Sprintf("unmapped-superpixels-z%d-%d.json", r.minz, r.maxz)
+}
+
+// WriteJSON writes the report as indented JSON into a directory.
+func (r *UnmappedReport) WriteJSON(dir string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, r.Filename())
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote unmapped superpixel report to %s\n", filename)
+	return nil
+}
@@ -0,0 +1,301 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MapIssue is a kind of consistency problem in a pair of Raveler maps.
+type MapIssue int
+
+const (
+	ConflictingSuperpixel MapIssue = iota // superpixel listed more than once with different segments
+	ConflictingSegment                    // segment listed more than once with different bodies
+	MissingSegment                        // superpixel's segment not in the segment->body map
+	UnreferencedSegment                   // segment not used by any superpixel
+	LargeSuperpixel                       // superpixel id exceeds 24 bits
+	EmptySlice                            // slice within the map's Z range without any entries
+
+	numMapIssues
+)
+
+var mapIssueNames = [numMapIssues]string{
+	"conflicting superpixels",
+	"conflicting segments",
+	"missing segments",
+	"unreferenced segments",
+	"superpixel ids over 24 bits",
+	"empty slices",
+}
+
+func (issue MapIssue) String() string {
+	if issue < 0 || issue >= numMapIssues {
+		return fmt.Sprintf("MapIssue(%d)", int(issue))
+	}
+	return mapIssueNames[issue]
+}
+
+// MaxIssueExamples is the number of examples kept for each kind of issue.
+const MaxIssueExamples = 10
+
+// MapValidation is the result of checking a superpixel->segment and segment->body map.
+type MapValidation struct {
+	NumSuperpixels int // distinct superpixels, excluding label 0
+	NumSegments    int // distinct segments in the segment->body map
+	NumBodies      int // distinct bodies in the segment->body map
+	NumSlices      int // slices with at least one entry
+	MinZ, MaxZ     int // range of slices in the superpixel->segment map
+
+	Counts   [numMapIssues]int
+	Examples [numMapIssues][]error // at most MaxIssueExamples, usually *MapError
+
+	emptyRuns int // runs of consecutive empty slices, each given by one example
+}
+
+// OK returns true if no issues were found.
+func (v *MapValidation) OK() bool {
+	for _, n := range v.Counts {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *MapValidation) add(issue MapIssue, err error) {
+	v.Counts[issue]++
+	if len(v.Examples[issue]) < MaxIssueExamples {
+		v.Examples[issue] = append(v.Examples[issue], err)
+	}
+}
+
+// addEarliest adds an issue found out of file order, keeping the examples that come
+// first in the file.
+func (v *MapValidation) addEarliest(issue MapIssue, err *MapError) {
+	v.Counts[issue]++
+	examples := v.Examples[issue]
+	i := sort.Search(len(examples), func(i int) bool { return examples[i].(*MapError).Line > err.Line })
+	if i == MaxIssueExamples {
+		return
+	}
+	if len(examples) < MaxIssueExamples {
+		examples = append(examples, nil)
+	}
+	copy(examples[i+1:], examples[i:])
+	examples[i] = err
+	v.Examples[issue] = examples
+}
+
+// Report writes a human-readable summary of the validation with examples of each issue.
+func (v *MapValidation) Report(w io.Writer) {
+	fmt.Fprintf(w, "superpixel->segment map: %d superpixels in %d slices", v.NumSuperpixels, v.NumSlices)
+	if v.NumSlices != 0 {
+		fmt.Fprintf(w, " (Z %d to %d)", v.MinZ, v.MaxZ)
+	}
+	fmt.Fprintf(w, "\nsegment->body map: %d segments in %d bodies\n", v.NumSegments, v.NumBodies)
+	if v.OK() {
+		fmt.Fprintf(w, "No problems found.\n")
+		return
+	}
+	for issue := MapIssue(0); issue < numMapIssues; issue++ {
+		if v.Counts[issue] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d\n", issue, v.Counts[issue])
+		for _, err := range v.Examples[issue] {
+			fmt.Fprintf(w, "    %s\n", err.Error())
+		}
+		total := v.Counts[issue]
+		if issue == EmptySlice {
+			total = v.emptyRuns
+		}
+		if more := total - len(v.Examples[issue]); more > 0 {
+			fmt.Fprintf(w, "    ... and %d more\n", more)
+		}
+	}
+}
+
+type segEntry struct {
+	segment    uint64
+	body       uint64
+	line       int
+	index      uint32 // position in the list of segments read
+	referenced bool
+	missing    bool // only in the superpixel->segment map
+}
+
+// spEntry is a line of the superpixel->segment map.  Entries are kept per slice
+// like a BodyTable, and segments are given by their index into the segments read,
+// which keeps an entry at 16 bytes.
+type spEntry struct {
+	label   uint32
+	segment uint32 // index of the segEntry
+	line    uint32
+	column  uint16 // column of the segment, or 0 if past 65535
+}
+
+// ValidateMaps reads a superpixel->segment and segment->body map and checks them for
+// superpixels or segments listed more than once with different mappings, segments that
+// are missing or never referenced, superpixel ids over 24 bits, and slices without
+// entries.  Malformed lines, including any with extra values, are returned as errors
+// since the maps can't be checked further.  The segment->body map is held in memory
+// while validating, as is every superpixel->segment line at 16 bytes each.
+func ValidateMaps(sp_to_seg, seg_to_body string) (*MapValidation, error) {
+	tlog := NewTimeLog()
+	v := new(MapValidation)
+
+	// Read the seg->body map, noting conflicting lines.
+	segs := make(map[uint64]*segEntry, 100000)
+	var segList []*segEntry
+	bodies := make(map[uint64]struct{})
+	mr, err := OpenMapFile(seg_to_body, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open segment->body map: %s", seg_to_body)
+	}
+	mr.Strict = true
+	var vals [3]uint64
+	for {
+		err := mr.Next(vals[:2])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			mr.Close()
+			return nil, err
+		}
+		segment, body := vals[0], vals[1]
+		if prev, found := segs[segment]; found {
+			if prev.body != body {
+				v.add(ConflictingSegment, mr.FieldErrorf(1, "segment %d mapped to body %d, but to body %d on line %d",
+					segment, body, prev.body, prev.line))
+			}
+			continue
+		}
+		seg := &segEntry{segment: segment, body: body, line: mr.Line(), index: uint32(len(segList))}
+		segs[segment] = seg
+		segList = append(segList, seg)
+		bodies[body] = struct{}{}
+	}
+	mr.Close()
+	v.NumSegments = len(segs)
+	v.NumBodies = len(bodies)
+	bodies = nil
+	tlog.Printf("Read segment->body map, %s", seg_to_body)
+
+	// Read the sp->seg map into per-slice lists, checking for duplicates once each
+	// slice's list is sorted.
+	sps := make(map[uint32][]spEntry)
+	if mr, err = OpenMapFile(sp_to_seg, 3); err != nil {
+		return nil, fmt.Errorf("Could not open superpixel->segment map: %s", sp_to_seg)
+	}
+	mr.Strict = true
+	defer mr.Close()
+	for {
+		err := mr.Next(vals[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		slice, superpixel, segment := vals[0], vals[1], vals[2]
+		if slice > 0xFFFFFFFF {
+			return nil, mr.FieldErrorf(0, "slice %d exceeds 32-bit value", slice)
+		}
+		if _, found := sps[uint32(slice)]; !found {
+			sps[uint32(slice)] = nil
+		}
+		if superpixel == 0 {
+			continue
+		}
+		if superpixel > 0x0000000000FFFFFF {
+			v.add(LargeSuperpixel, mr.FieldErrorf(1, "superpixel id %d exceeds 24-bit value", superpixel))
+			continue
+		}
+		if mr.Line() > 0xFFFFFFFF {
+			return nil, mr.Errorf("superpixel->segment map has more than %d lines", uint32(0xFFFFFFFF))
+		}
+		seg, found := segs[segment]
+		if !found {
+			seg = &segEntry{segment: segment, line: mr.Line(), index: uint32(len(segList)), missing: true}
+			segs[segment] = seg
+			segList = append(segList, seg)
+		}
+		entry := spEntry{label: uint32(superpixel), segment: seg.index, line: uint32(mr.Line())}
+		if col := mr.Column(2); col <= 0xFFFF {
+			entry.column = uint16(col)
+		}
+		sps[uint32(slice)] = append(sps[uint32(slice)], entry)
+	}
+	tlog.Printf("Read superpixel->segment map, %s", sp_to_seg)
+
+	// Check each slice's superpixels in label order.  Entries for the same label stay
+	// in file order, so the first is the one later lines are compared with.
+	zs := make([]uint32, 0, len(sps))
+	for z := range sps {
+		zs = append(zs, z)
+	}
+	sort.Slice(zs, func(i, j int) bool { return zs[i] < zs[j] })
+	for _, z := range zs {
+		entries := sps[z]
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].label < entries[j].label })
+		var first spEntry
+		for i, entry := range entries {
+			if i > 0 && entry.label == first.label {
+				if entry.segment != first.segment {
+					v.addEarliest(ConflictingSuperpixel, &MapError{sp_to_seg, int(entry.line), int(entry.column),
+						fmt.Sprintf("superpixel (%d, %d) mapped to segment %d, but to segment %d on line %d",
+							z, entry.label, segList[entry.segment].segment, segList[first.segment].segment, first.line)})
+				}
+				continue
+			}
+			first = entry
+			v.NumSuperpixels++
+			seg := segList[entry.segment]
+			if seg.missing {
+				v.addEarliest(MissingSegment, &MapError{sp_to_seg, int(entry.line), int(entry.column),
+					fmt.Sprintf("segment %d not found in %s", seg.segment, seg_to_body)})
+			} else {
+				seg.referenced = true
+			}
+		}
+		sps[z] = nil
+	}
+	v.NumSlices = len(zs)
+
+	// Report unreferenced segments in file order.
+	var unreferenced []*segEntry
+	for _, seg := range segList {
+		if !seg.referenced && !seg.missing {
+			unreferenced = append(unreferenced, seg)
+		}
+	}
+	sort.Slice(unreferenced, func(i, j int) bool { return unreferenced[i].line < unreferenced[j].line })
+	for _, seg := range unreferenced {
+		v.add(UnreferencedSegment, &MapError{seg_to_body, seg.line, 1,
+			fmt.Sprintf("segment %d not used by any superpixel", seg.segment)})
+	}
+
+	// Report runs of empty slices between the first and last slice.
+	if len(zs) != 0 {
+		v.MinZ, v.MaxZ = int(zs[0]), int(zs[len(zs)-1])
+		for i := 1; i < len(zs); i++ {
+			first, last := zs[i-1]+1, zs[i]-1
+			if first > last {
+				continue
+			}
+			v.Counts[EmptySlice] += int(last-first) + 1
+			v.emptyRuns++
+			if len(v.Examples[EmptySlice]) >= MaxIssueExamples {
+				continue
+			}
+			if first == last {
+				v.Examples[EmptySlice] = append(v.Examples[EmptySlice], fmt.Errorf("slice %d has no entries", first))
+			} else {
+				v.Examples[EmptySlice] = append(v.Examples[EmptySlice], fmt.Errorf("slices %d to %d have no entries", first, last))
+			}
+		}
+	}
+	return v, nil
+}
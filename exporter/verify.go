@@ -0,0 +1,335 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// BodyMismatch counts the voxels of a slab where an expected body was read back as
+// another label.
+type BodyMismatch struct {
+	Expected uint64
+	Found    uint64 // label found at the first mismatched voxel
+	Voxels   int
+}
+
+// SlabCheck is the result of comparing one slab file with the Raveler source.
+type SlabCheck struct {
+	Origin [3]int
+	File   string // empty if the slab is missing
+	Err    error  // error reading the slab file
+
+	Mismatched int // voxels that differ from the expected body
+	Padding    int // voxels outside the images or in slices without images that aren't 0
+
+	// Valid extent expected in the slab's sidecar if it records another extent.
+	WrongExtent bool
+	ValidMin    [3]int
+	ValidMax    [3]int
+
+	bodies map[uint64]*BodyMismatch
+}
+
+// OK returns true if the slab was read and matches the source.
+func (c *SlabCheck) OK() bool {
+	return c.File != "" && c.Err == nil && c.Mismatched == 0 && c.Padding == 0 && !c.WrongExtent
+}
+
+// Mismatches returns the mismatched voxel counts of each expected body, most first.
+func (c *SlabCheck) Mismatches() []BodyMismatch {
+	bodies := make([]BodyMismatch, 0, len(c.bodies))
+	for _, b := range c.bodies {
+		bodies = append(bodies, *b)
+	}
+	sort.Slice(bodies, func(i, j int) bool {
+		if bodies[i].Voxels != bodies[j].Voxels {
+			return bodies[i].Voxels > bodies[j].Voxels
+		}
+		return bodies[i].Expected < bodies[j].Expected
+	})
+	return bodies
+}
+
+func (c *SlabCheck) mismatch(expected, found uint64) {
+	c.Mismatched++
+	if c.bodies == nil {
+		c.bodies = make(map[uint64]*BodyMismatch)
+	}
+	b, ok := c.bodies[expected]
+	if !ok {
+		b = &BodyMismatch{Expected: expected, Found: found}
+		c.bodies[expected] = b
+	}
+	b.Voxels++
+}
+
+// Verification is the result of comparing exported slab files with the Raveler source.
+type Verification struct {
+	SlabSize  [3]int
+	NumSlices int // superpixel images compared
+	NumSlabs  int // slab files compared
+	Slabs     []*SlabCheck
+}
+
+// OK returns true if every expected slab was found and matches the source.
+func (v *Verification) OK() bool {
+	for _, c := range v.Slabs {
+		if !c.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// Report writes a human-readable summary of the slabs that don't match the source.
+func (v *Verification) Report(w io.Writer) {
+	fmt.Fprintf(w, "Compared %d superpixel images with %d slab files of %d x %d x %d voxels\n",
+		v.NumSlices, v.NumSlabs, v.SlabSize[0], v.SlabSize[1], v.SlabSize[2])
+	var bad int
+	for _, c := range v.Slabs {
+		if c.OK() {
+			continue
+		}
+		bad++
+		where := fmt.Sprintf("slab @ (%d,%d,%d)", c.Origin[0], c.Origin[1], c.Origin[2])
+		switch {
+		case c.File == "":
+			fmt.Fprintf(w, "%s: missing\n", where)
+			continue
+		case c.Err != nil:
+			fmt.Fprintf(w, "%s: %s\n", where, c.Err.Error())
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\n", where, c.File)
+		if c.WrongExtent {
+			fmt.Fprintf(w, "    sidecar's valid extent should be %v to %v\n", c.ValidMin, c.ValidMax)
+		}
+		if c.Padding != 0 {
+			fmt.Fprintf(w, "    %d padding voxels aren't 0\n", c.Padding)
+		}
+		if c.Mismatched != 0 {
+			bodies := c.Mismatches()
+			fmt.Fprintf(w, "    %d voxels of %d bodies differ:\n", c.Mismatched, len(bodies))
+			for i, b := range bodies {
+				if i == MaxIssueExamples {
+					fmt.Fprintf(w, "      ... and %d more bodies\n", len(bodies)-MaxIssueExamples)
+					break
+				}
+				fmt.Fprintf(w, "      body %d: %d voxels, e.g., read as %d\n", b.Expected, b.Voxels, b.Found)
+			}
+		}
+	}
+	if bad == 0 {
+		fmt.Fprintf(w, "All slabs match.\n")
+	} else {
+		fmt.Fprintf(w, "%d of %d slabs have problems.\n", bad, len(v.Slabs))
+	}
+}
+
+// slabFiles returns the slab files in a directory by origin and their slab size.
+func slabFiles(dir string) (map[[3]int]string, [3]int, error) {
+	var size [3]int
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, size, err
+	}
+	files := make(map[[3]int]string)
+	for _, entry := range entries {
+		md, err := slabs.ParseName(entry.Name())
+		if err != nil {
+			continue // not a slab file
+		}
+		if len(files) == 0 {
+			size = md.Size
+		} else if md.Size != size {
+			return nil, size, fmt.Errorf("slab files in %s have different sizes: %v and %v", dir, size, md.Size)
+		}
+		if other, found := files[md.Origin]; found {
+			return nil, size, fmt.Errorf("two slab files with the same origin: %s and %s", other, entry.Name())
+		}
+		files[md.Origin] = filepath.Join(dir, entry.Name())
+	}
+	if len(files) == 0 {
+		return nil, size, fmt.Errorf("no slab files found in %s", dir)
+	}
+	return files, size, nil
+}
+
+// VerifySlabs compares the slab files exported to a directory with the body of each
+// voxel computed directly from the superpixel images and maps given in the options,
+// using the same body offset, ROI, and unmapped superpixel policy.  Voxels of the
+// zero padding past the edges of the images and in slices without images must be 0.
+// Slabs within the ROI that have no file are reported as missing.  The slab size is
+// taken from the file names.
+func VerifySlabs(opts Options, dir string) (*Verification, error) {
+	files, size, err := slabFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	opts.SlabX, opts.SlabY, opts.SlabZ = size[0], size[1], size[2]
+	e := &Exporter{opts: opts, source: opts.pngSource()}
+
+	var roi *roiMask
+	if opts.ROIFile != "" {
+		if roi, err = loadROI(opts.ROIFile, opts.ROIBlockSize); err != nil {
+			return nil, err
+		}
+	}
+	sp2body, err := opts.BodyTable()
+	if err != nil {
+		return nil, err
+	}
+	defer sp2body.Close()
+
+	lv := &layerVerifier{v: &Verification{SlabSize: size}, e: e, files: files, roi: roi, zoffset: -1}
+	err = e.source.Walk(opts.MinZ, opts.MaxZ, func(plane Plane) error {
+		return lv.addPlane(plane, sp2body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	lv.finishLayer()
+	return lv.v, nil
+}
+
+// layerVerifier compares the superpixel planes of a layer with its slabs.
+type layerVerifier struct {
+	v     *Verification
+	e     *Exporter
+	files map[[3]int]string
+	roi   *roiMask
+
+	nx, ny  int
+	zoffset int           // first Z of the current layer
+	cols    int           // # of slabs along X
+	slabs   []*slabs.File // slabs of the current layer by row and column, nil if unreadable
+	checks  []*SlabCheck  // checks of the current layer by row and column, nil if not expected
+	planes  map[int]bool  // slices of the current layer with images
+	labels  []uint64      // expected bodies of a row
+	ids     []uint32      // superpixel ids of a row
+	ranges  []xRange
+}
+
+// startLayer reads the slab files of the layer starting at zoffset.
+func (lv *layerVerifier) startLayer(zoffset int) {
+	opts := lv.e.opts
+	lv.zoffset = zoffset
+	lv.planes = make(map[int]bool)
+	lv.cols = (lv.nx + opts.SlabX - 1) / opts.SlabX
+	rows := (lv.ny + opts.SlabY - 1) / opts.SlabY
+	lv.slabs = make([]*slabs.File, rows*lv.cols)
+	lv.checks = make([]*SlabCheck, rows*lv.cols)
+	for i := range lv.slabs {
+		ox, oy := (i%lv.cols)*opts.SlabX, (i/lv.cols)*opts.SlabY
+		origin := [3]int{ox, oy, zoffset}
+		c := &SlabCheck{Origin: origin, File: lv.files[origin]}
+		if c.File == "" {
+			if lv.roi != nil && !lv.roi.intersects(ox, ox+opts.SlabX, oy, oy+opts.SlabY, zoffset, zoffset+opts.SlabZ) {
+				continue // not written because it's outside the ROI
+			}
+		} else if lv.slabs[i], c.Err = slabs.Read(c.File); c.Err == nil {
+			lv.v.NumSlabs++
+		}
+		lv.checks[i] = c
+		lv.v.Slabs = append(lv.v.Slabs, c)
+	}
+}
+
+// addPlane compares a superpixel plane with the slabs of its layer.
+func (lv *layerVerifier) addPlane(plane Plane, sp2body *BodyTable) error {
+	opts := lv.e.opts
+	b := plane.Image.Bounds()
+	if lv.zoffset < 0 {
+		lv.nx, lv.ny = b.Dx(), b.Dy()
+		lv.labels = make([]uint64, lv.nx)
+		lv.ids = make([]uint32, lv.nx)
+	} else if b.Dx() != lv.nx || b.Dy() != lv.ny {
+		return fmt.Errorf("superpixel image changes sizes: expected %d x %d and got %d x %d: %s",
+			lv.nx, lv.ny, b.Dx(), b.Dy(), plane.Name)
+	}
+	if zoffset := opts.ZHead(plane.Z); zoffset != lv.zoffset {
+		lv.finishLayer()
+		lv.startLayer(zoffset)
+	}
+	lv.planes[plane.Z] = true
+	lv.v.NumSlices++
+
+	r := lv.e.newRelabeler(sp2body, plane.Z)
+	for y := 0; y < lv.ny; y++ {
+		for i := range lv.labels {
+			lv.labels[i] = 0
+		}
+		lv.ranges = rowRanges(lv.roi, y, plane.Z, 0, lv.nx, lv.ranges)
+		for _, xr := range lv.ranges {
+			if err := superpixelRow(plane.Image, plane.Format, y+b.Min.Y, xr.x0+b.Min.X, xr.x1+b.Min.X, lv.ids); err != nil {
+				return err
+			}
+			r.relabel(lv.ids[:xr.x1-xr.x0], lv.labels[xr.x0:xr.x1])
+		}
+		row := (y / opts.SlabY) * lv.cols
+		for x, expected := range lv.labels {
+			i := row + x/opts.SlabX
+			slab := lv.slabs[i]
+			if slab == nil {
+				continue
+			}
+			if found := slab.Label(x, y, plane.Z); found != expected {
+				lv.checks[i].mismatch(expected, found)
+			}
+		}
+	}
+	return nil
+}
+
+// finishLayer checks the padding of the current layer's slabs is 0 and that their
+// sidecars, if any, record the extent of the images.
+func (lv *layerVerifier) finishLayer() {
+	if lv.zoffset < 0 {
+		return
+	}
+	z0, z1 := lv.zoffset+lv.e.opts.SlabZ, lv.zoffset
+	for z := range lv.planes {
+		if z < z0 {
+			z0 = z
+		}
+		if z >= z1 {
+			z1 = z + 1
+		}
+	}
+	for i, slab := range lv.slabs {
+		if slab == nil {
+			continue
+		}
+		md := slab.Metadata
+		if slab.HasSidecar {
+			c := lv.checks[i]
+			c.ValidMin = [3]int{md.Origin[0], md.Origin[1], z0}
+			c.ValidMax = [3]int{md.Origin[0] + md.Size[0], md.Origin[1] + md.Size[1], z1}
+			if c.ValidMax[0] > lv.nx {
+				c.ValidMax[0] = lv.nx
+			}
+			if c.ValidMax[1] > lv.ny {
+				c.ValidMax[1] = lv.ny
+			}
+			c.WrongExtent = md.ValidMin != c.ValidMin || md.ValidMax != c.ValidMax
+		}
+		for z := md.Origin[2]; z < md.Origin[2]+md.Size[2]; z++ {
+			for y := md.Origin[1]; y < md.Origin[1]+md.Size[1]; y++ {
+				for x := md.Origin[0]; x < md.Origin[0]+md.Size[0]; x++ {
+					if lv.planes[z] && x < lv.nx && y < lv.ny {
+						continue
+					}
+					if slab.Label(x, y, z) != 0 {
+						lv.checks[i].Padding++
+					}
+				}
+			}
+		}
+	}
+	lv.slabs = nil
+}
@@ -0,0 +1,145 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/raveler-exporter/slabs"
+)
+
+// TestSlabFilesRoundTrip checks that slab files and sidecars written by an export
+// read back as the exported slabs, and that verify finds slab files that were
+// changed, corrupted, removed or given a wrong sidecar.
+func TestSlabFilesRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	opts := sequential(writeTestSession(t, dir))
+	opts.OutDir = filepath.Join(dir, "out")
+	opts.Compression = "gzip"
+	opts.BodyOffset = 100
+	runExport(t, opts)
+	want := exportSlabs(t, opts)
+
+	filename := func(origin [3]int) string {
+		return filepath.Join(opts.OutDir, mustSlabName(t, Slab{Origin: origin, Size: [3]int{64, 32, 8}}, "gzip"))
+	}
+	for _, slab := range want {
+		sf, err := slabs.Read(filename(slab.Origin))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := sf.Metadata
+		if !sf.HasSidecar || md.Origin != slab.Origin || md.Size != slab.Size || md.Compression != "gzip" || md.BodyOffset != 100 {
+			t.Fatalf("slab @ %v has metadata %+v", slab.Origin, md)
+		}
+		if md.ValidMin != slab.ValidMin || md.ValidMax != slab.ValidMax {
+			t.Errorf("slab @ %v has valid extent %v to %v in its sidecar, expected %v to %v",
+				slab.Origin, md.ValidMin, md.ValidMax, slab.ValidMin, slab.ValidMax)
+		}
+		if md.Session.SuperpixelToSegment != opts.SuperpixelToSegment || md.Session.SuperpixelDir != opts.SuperpixelDir {
+			t.Errorf("slab @ %v has session %+v", slab.Origin, md.Session)
+		}
+		if !reflect.DeepEqual(sf.Labels, slabLabels(slab)) {
+			t.Errorf("slab @ %v read back with different labels", slab.Origin)
+		}
+	}
+
+	v, err := VerifySlabs(opts, opts.OutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.OK() || v.NumSlabs != len(want) || v.NumSlices != testMaxZ-testMinZ+1 {
+		var report bytes.Buffer
+		v.Report(&report)
+		t.Fatalf("verify of exported slabs failed:\n%s", report.String())
+	}
+
+	// Rewrite one slab, with a valid sidecar, with a different body at one voxel.
+	changed := [3]int{0, 0, 8}
+	var changedBody uint64
+	for _, slab := range want {
+		if slab.Origin == changed {
+			changedBody = slabLabels(slab)[0]
+			slab.Data[0] ^= 0x80
+			fs, err := NewFileSink(opts.OutDir, "gzip", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.Sidecars = true
+			if err := fs.WriteSlab(slab); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Corrupt another slab file, remove a third, and give a fourth a wrong extent.
+	corrupted, missing, extent := [3]int{64, 0, 8}, [3]int{0, 32, 8}, [3]int{128, 0, 8}
+	data, err := os.ReadFile(filename(corrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	writeTestFile(t, filename(corrupted), data)
+	for _, name := range []string{filename(missing), filename(missing) + slabs.SidecarExt} {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	md, err := slabs.ReadMetadata(filename(extent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.ValidMax[0] != testWidth {
+		t.Errorf("slab at the edge of the images has valid extent to X %d, expected %d", md.ValidMax[0], testWidth)
+	}
+	md.ValidMax[0] = extent[0] + 64
+	data, err = json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filename(extent)+slabs.SidecarExt, data)
+
+	if v, err = VerifySlabs(opts, opts.OutDir); err != nil {
+		t.Fatal(err)
+	}
+	if c := checkAt(t, v, changed); c.Mismatched != 1 || len(c.Mismatches()) != 1 || c.Mismatches()[0].Expected != changedBody {
+		t.Errorf("changed slab: %d voxels mismatched: %+v", c.Mismatched, c.Mismatches())
+	}
+	if c := checkAt(t, v, corrupted); c.Err == nil || !strings.Contains(c.Err.Error(), "checksum") {
+		t.Errorf("corrupted slab: expected checksum error, got %v", c.Err)
+	}
+	if c := checkAt(t, v, missing); c.File != "" {
+		t.Errorf("removed slab not reported as missing")
+	}
+	if c := checkAt(t, v, extent); !c.WrongExtent || c.ValidMax[0] != testWidth {
+		t.Errorf("slab with wrong extent in sidecar: %+v", c)
+	}
+	var report bytes.Buffer
+	v.Report(&report)
+	for _, s := range []string{"missing", "checksum", "sidecar's valid extent should be", "1 voxels of 1 bodies differ", "4 of"} {
+		if !strings.Contains(report.String(), s) {
+			t.Errorf("verify report doesn't mention %q:\n%s", s, report.String())
+		}
+	}
+	for _, c := range v.Slabs {
+		if c.Origin != changed && c.Origin != corrupted && c.Origin != missing && c.Origin != extent && !c.OK() {
+			t.Errorf("unchanged slab @ %v failed verify", c.Origin)
+		}
+	}
+}
+
+// checkAt returns the verify result for the slab at an origin.
+func checkAt(t *testing.T, v *Verification, origin [3]int) *SlabCheck {
+	t.Helper()
+	for _, c := range v.Slabs {
+		if c.Origin == origin {
+			return c
+		}
+	}
+	t.Fatalf("no verify result for slab @ %v", origin)
+	return nil
+}
@@ -7,11 +7,10 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
-	"time"
+
+	"github.com/janelia-flyem/raveler-exporter/exporter"
 )
 
 var (
@@ -22,6 +21,14 @@ var (
 	outdir = flag.String("outdir", "", "")
 	url    = flag.String("url", "", "")
 
+	dvidVerify   = flag.Bool("dvidverify", false, "")
+	protocol     = flag.String("protocol", exporter.ProtocolRaw, "")
+	blockSize    = flag.Int("blocksize", exporter.DefaultOptions().DVIDBlockSize, "")
+	dvidTimeout  = flag.Duration("dvidtimeout", exporter.DefaultOptions().DVIDTimeout, "")
+	dvidRetries  = flag.Int("dvidretries", exporter.DefaultOptions().DVIDRetries, "")
+	dvidThrottle = flag.Duration("dvidthrottle", exporter.DefaultOptions().DVIDThrottleWait, "")
+	dvidDeadline = flag.Duration("dviddeadline", 0, "")
+
 	slabX = flag.Int("slabX", 512, "")
 	slabY = flag.Int("slabY", 512, "")
 	slabZ = flag.Int("slabZ", 32, "")
@@ -30,14 +37,35 @@ var (
 
 	bodyoffset = flag.Int("bodyoffset", 0, "")
 
+	supervoxels = flag.Bool("supervoxels", false, "")
+
+	unmapped     = flag.String("unmapped", exporter.UnmappedZero, "")
+	unmappedBody = flag.Uint64("unmappedbody", 0, "")
+
 	minz = flag.Int("minz", 0, "")
 	maxz = flag.Int("maxz", math.MaxInt32, "")
 
 	// How the output should be compressed
 	compression = flag.String("compress", "lz4", "")
+	overwrite   = flag.String("overwrite", exporter.OverwriteAlways, "")
+	sidecars    = flag.Bool("sidecars", true, "")
 
 	roiFile = flag.String("roi", "", "")
 
+	decoders   = flag.Int("decoders", exporter.DefaultOptions().DecodeWorkers, "")
+	relabelers = flag.Int("relabelers", exporter.DefaultOptions().RelabelWorkers, "")
+	writeQueue = flag.Int("writequeue", exporter.DefaultOptions().WriteQueue, "")
+
+	slabWorkers = flag.Int("slabworkers", exporter.DefaultOptions().SlabWorkers, "")
+	maxInflight = flag.Int64("maxinflight", exporter.DefaultOptions().MaxInflightBytes, "")
+
+	memlimit = flag.Int64("memlimit", 0, "")
+
+	resume   = flag.Bool("resume", false, "")
+	stateDir = flag.String("statedir", "", "")
+
+	bodymap = flag.String("bodymap", "", "")
+
 	// output file for cluster script
 	script      = flag.String("script", "", "")
 	binpath     = flag.String("binpath", "/groups/flyem/proj/builds/cluster2015/bin", "")
@@ -48,21 +76,102 @@ const helpMessage = `
 raveler-exporter converts Raveler superpixel-based images + maps to a series of compressed label slabs.
 
 Usage: raveler-exporter [options] <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory> 
+       raveler-exporter [options] <command> <arguments>
+
+Commands:
+
+	    index-map <superpixel-to-segment-map>
+	                  Write a slice index next to the map so jobs only read lines for their -minz/-maxz range.
+
+	    compile-map <superpixel-to-segment-map> <segment-to-body-map> <output file>
+	                  Write the superpixel->body map for slices in -minz/-maxz as a binary file for -bodymap,
+	                  then read it back to check its checksum.  Export jobs don't recheck the whole file.
+
+	    validate <superpixel-to-segment-map> <segment-to-body-map>
+	                  Check the maps for conflicting duplicate lines, missing or unreferenced segments,
+	                  superpixel ids over 24 bits, and empty slices.  Exits with status 1 on problems.
+
+	    plan <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory>
+	                  Estimate peak memory, # of slabs, and output size for each compression from the image
+	                  headers and map sizes without exporting, and the same per job for -filesperjob.
+
+	    verify <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory> <slab directory>
+	                  Recompute the body of every voxel in -minz/-maxz from the images and maps, using
+	                  -bodyoffset, -roi and -unmapped, and compare them with the slab files in the directory.
+	                  Reports missing slabs, mismatched voxels by slab and body, and nonzero padding.
+	                  Exits with status 1 on problems.
+
+	    audit-dvid <DVID data URL> <slab directory>
+	                  GET the region of each slab file in the directory from DVID and compare it with the file.
+	                  Slabs whose sidecars mark them as supervoxels are read with supervoxels=true.
+	                  Writes the differences to dvid-audit.json in the slab directory.  Exits with status 1
+	                  if any slab differs.
+
+	    inspect <slab file or compiled map>
+	                  Decompress one slab file and print its size, origin, valid extent and compression,
+	                  read from its sidecar if there is one, and the voxel count of each distinct body.
+	                  Given a compiled map, check its checksum and body indices and summarize it.
+
+	    check-images <superpixel-to-segment-map> <segment-to-body-map> <superpixels directory> <report file>
+	                  Decode each superpixel image in -minz/-maxz once and write a JSON report of superpixel
+	                  ids missing from the mapping and mappings that appear in no image.  Uses -bodymap if given.
+	                  Exits with status 1 if any superpixel id is unmapped.
+
+Options:
 
 		-outdir         =string   Output directory for file output
 		-url            =string   POST URL for DVID, e.g., "http://dvidserver.com/api/653/dataname"
+	    -protocol       =string   How slabs are sent to DVID: "raw" (default) POSTs each slab to <url>/raw/0_1_2/...
+	                              for any labels type, and "blocks" POSTs compressed blocks to <url>/blocks for
+	                              labelarray and labelmap instances; labelblk instances are rejected.  Slab sizes
+	                              must be multiples of -blocksize, so with the default 64 also set -slabZ=64.
+	    -blocksize      =number   Block size of the DVID instance for -protocol=blocks (default 64)
+	    -dvidverify     (flag)    GET each slab back from DVID after it is POSTed and compare it with the slab sent.
+	                              A slab that differs stops the export and isn't recorded in the progress manifest.
+	                              Differences are written to dvid-verify-z*.json next to the manifest.
+	    -dvidtimeout    =duration Time limit for each request to DVID, e.g., "90s" (default 10m)
+	    -dvidretries    =number   Times a request is retried after network errors, timeouts, or 500, 502 and 504
+	                              responses, backing off exponentially or as long as Retry-After asks (default 8)
+	    -dvidthrottle   =duration How long to keep retrying a request DVID throttles with 429 or 503 responses,
+	                              which don't count against -dvidretries.  0 retries indefinitely. (default 24h)
+	    -dviddeadline   =duration If set, stop retrying a request this long after its first attempt.
 
 	    -compress       =string   Compression for output files.  default "lz4" but allows "gzip" and "none".
+	    -overwrite      =string   What to do with slab files that already exist in -outdir: "overwrite" (default),
+	                              "skip-existing" to keep them, or "fail-if-exists" to stop the export.
+	                              Kept slabs aren't recorded in the progress manifest.
+	    -sidecars       (flag)    Write a JSON description of each slab file next to it, named by appending
+	                              ".json" to the file name (default true).  Use -sidecars=false to disable.
 
 	    -script         =string   Generate batch script for running on SGE cluster (requires -directory)
+	                              The script first compiles the superpixel->body map to -bodymap, or to
+	                              the script name + ".bodymap" if -bodymap isn't given.
 	    -filesperjob    =number   Number of Z slices that should be assigned to one cluster job if using -script.
 	    -binpath        =string   Absolute path to this executable for script creation.
 
-	    -roi            =string   Absolute path to a ROI JSON containing sorted (in ascending order) block index spans
+	    -roi            =string   Absolute path to a ROI JSON containing block index spans.  Voxels outside the ROI
+	                              are set to 0, and slabs entirely outside the ROI aren't written.
 	    -roiblocksize   =number   Size of each ROI block in pixels diameter (default 32)
 
+	    -bodymap        =string   Compiled superpixel->body map from compile-map to use instead of the text maps.
+
 	    -bodyoffset     =number   Offset to apply to body labels, e.g., if 1000 all body labels are incremented by 1000.
 
+	    -supervoxels    (flag)    Write supervoxel ids, slice << 24 | superpixel, instead of bodies.  After the slabs,
+	                              the supervoxel->body mapping is POSTed to <url>/mappings of the DVID labelmap
+	                              instance and written to supervoxel-bodies-z*.txt in -outdir, so later
+	                              agglomeration changes only need new mappings.  Superpixels of body 0 get no
+	                              mapping, so DVID treats each as its own body rather than as background.
+	                              Requires a labelmap instance and an -unmapped policy other than "zero".
+	                              Use -bodyoffset to keep body ids from colliding with supervoxel ids.
+	                              Pass the same flag to verify.
+
+	    -unmapped       =string   How to label superpixels missing from the mapping: "zero" (default) for body 0,
+	                              "fail" to stop the export, "sentinel" for body -unmappedbody, or "unique" for
+	                              body -unmappedbody + (slice << 24 | superpixel).  Unmapped superpixels are
+	                              summarized per slice and in unmapped-superpixels-z*.json in -outdir.
+	    -unmappedbody   =number   Body for the "sentinel" policy or base body for the "unique" policy.
+
 	    -slabX          =number   Size along X of label slab (default 512)
 	    -slabY          =number   Size along Y of label slab (default 512)
 	    -slabZ          =number   Size along Z of label slab (default 32)
@@ -70,29 +179,31 @@ Usage: raveler-exporter [options] <superpixel-to-segment-map> <segment-to-body-m
 	    -minz           =number   Starting Z slice to process.
 	    -maxz           =number   Ending Z slice to process.
 
+	    -decoders       =number   Number of superpixel images decoded concurrently (default 2)
+	    -relabelers     =number   Number of goroutines relabeling each slice (default # of CPUs)
+	    -writequeue     =number   Number of completed layers of slabZ slices that may wait to be written
+	                              while the next layer is read (default 1).  Each needs another layer
+	                              buffer in memory.  Use 0 to write each layer before reading the next.
+	    -slabworkers    =number   Number of slabs packed, compressed and sent at once (default # of CPUs)
+	    -maxinflight    =number   Maximum uncompressed bytes of slabs being written at once (default 1 GiB).
+	                              Lowers the number of slab workers for large slabs.  Use 0 for no limit.
+	    -memlimit       =number   Memory budget in bytes for very large slices.  Superpixel images are read row by
+	                              row and each layer is processed in bands of slab rows that fit the budget.
+
+	    -resume         (flag)    Skip slabs recorded as written in the progress manifest of an earlier run
+	                              with the same options, Z range and superpixel->body mapping, and export
+	                              only the rest.
+	    -statedir       =string   Directory for the progress manifest, export-manifest-z*.jsonl, which lists
+	                              each written slab with its origin, size, byte count and checksum.
+	                              (default -outdir, or the current directory for DVID-only exports)
+
 	    -dryrun         (flag)    Don't write files or send POST requests to DVID
 	-h, -help           (flag)    Show help message
 
-We assume there is enough RAM to hold the both mapping files.
+The superpixel->body mapping is kept in a compact table of roughly 4-8 bytes per superpixel.
+Only mappings for slices within -minz and -maxz are loaded.
 `
 
-// TimeLog adds elapsed time to logging.
-// Example:
-//     mylog := NewTimeLog()
-//     ...
-//     mylog.Printf("stuff happened")  // Appends elapsed time from NewTimeLog() to message.
-type TimeLog struct {
-	start time.Time
-}
-
-func NewTimeLog() TimeLog {
-	return TimeLog{time.Now()}
-}
-
-func (t TimeLog) Printf(format string, args ...interface{}) {
-	log.Printf(format+": %s\n", append(args, time.Since(t.start))...)
-}
-
 var usage = func() {
 	fmt.Printf(helpMessage)
 }
@@ -105,29 +216,86 @@ func currentDir() string {
 	return currentDir
 }
 
+// exportOptions returns the export options given by the command-line flags.
+func exportOptions() exporter.Options {
+	opts := exporter.DefaultOptions()
+	opts.OutDir = *outdir
+	opts.URL = *url
+	opts.DVIDVerify = *dvidVerify
+	opts.DVIDProtocol = *protocol
+	opts.DVIDBlockSize = *blockSize
+	opts.DVIDTimeout = *dvidTimeout
+	opts.DVIDRetries = *dvidRetries
+	opts.DVIDThrottleWait = *dvidThrottle
+	opts.DVIDDeadline = *dvidDeadline
+	opts.SlabX = *slabX
+	opts.SlabY = *slabY
+	opts.SlabZ = *slabZ
+	opts.ROIFile = *roiFile
+	opts.ROIBlockSize = *roiBlocksize
+	opts.BodyOffset = *bodyoffset
+	opts.Supervoxels = *supervoxels
+	opts.MinZ = *minz
+	opts.MaxZ = *maxz
+	opts.Compression = *compression
+	opts.Overwrite = *overwrite
+	opts.Sidecars = *sidecars
+	opts.DryRun = *dryrun
+	opts.BodyMap = *bodymap
+	opts.Unmapped = *unmapped
+	opts.UnmappedBody = *unmappedBody
+	opts.DecodeWorkers = *decoders
+	opts.RelabelWorkers = *relabelers
+	opts.WriteQueue = *writeQueue
+	opts.SlabWorkers = *slabWorkers
+	opts.MaxInflightBytes = *maxInflight
+	opts.MemLimit = *memlimit
+	opts.Resume = *resume
+	opts.StateDir = *stateDir
+	return opts
+}
+
 func main() {
 	flag.BoolVar(showHelp, "h", false, "Show help message")
 	flag.Usage = usage
 	flag.Parse()
 
-	if *showHelp || flag.NArg() != 3 {
+	if *showHelp || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	if cmd, found := commands[flag.Arg(0)]; found {
+		if err := runCommand(cmd, flag.Args()[1:]); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flag.NArg() != 3 {
 		flag.Usage()
 		os.Exit(0)
 	}
 
-	if *slabZ < 1 {
-		fmt.Printf("Thickness must be >= 1 Z slice\n")
+	args := flag.Args()
+	opts := exportOptions()
+	opts.SuperpixelToSegment = args[0]
+	opts.SegmentToBody = args[1]
+	opts.SuperpixelDir = args[2]
+
+	if err := opts.Validate(); err != nil {
+		fmt.Printf("%s\n", err.Error())
 		os.Exit(1)
 	}
 
-	if *url == "" && *outdir == "" {
+	if opts.URL == "" && opts.OutDir == "" {
 		fmt.Printf("Must either use -url and/or -outdir for output!\n")
 		os.Exit(1)
 	}
 
-	args := flag.Args()
 	if *script != "" {
-		if err := generateScript(args[0], args[1], args[2], *outdir); err != nil {
+		if err := generateScript(opts); err != nil {
 			fmt.Printf("Error generating script: %s\n", err.Error())
 			os.Exit(1)
 		}
@@ -137,12 +305,23 @@ func main() {
 	numCPU := runtime.NumCPU()
 	runtime.GOMAXPROCS(numCPU)
 
-	if err := processRavelerExport(args[0], args[1], args[2]); err != nil {
+	e, err := exporter.New(opts)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := e.Run(); err != nil {
 		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
 	}
 }
 
-func generateScript(sp_to_seg, seg_to_body, sp_dir, out_dir string) error {
+// Name of the cluster job that compiles the superpixel->body map.
+const compileJobName = "ravelerexport-compile"
+
+func generateScript(opts exporter.Options) error {
+	sp_to_seg, seg_to_body, sp_dir := opts.SuperpixelToSegment, opts.SegmentToBody, opts.SuperpixelDir
+
 	fmt.Printf("Generating batcn script: %s\n", *script)
 
 	file, err := os.Create(*script)
@@ -151,120 +330,130 @@ func generateScript(sp_to_seg, seg_to_body, sp_dir, out_dir string) error {
 	}
 	defer file.Close()
 
-	fileregex, err := regexp.Compile(`[[:digit:]]+\.png$`)
-	if err != nil {
-		return err
-	}
-
+	defaults := exporter.DefaultOptions()
 	var options []string
-	if *slabX != 512 {
-		options = append(options, fmt.Sprintf("-slabX=%d", *slabX))
+	if opts.SlabX != 512 {
+		options = append(options, fmt.Sprintf("-slabX=%d", opts.SlabX))
 	}
-	if *slabY != 512 {
-		options = append(options, fmt.Sprintf("-slabY=%d", *slabY))
+	if opts.SlabY != 512 {
+		options = append(options, fmt.Sprintf("-slabY=%d", opts.SlabY))
 	}
-	if *slabZ != 32 {
-		options = append(options, fmt.Sprintf("-slabZ=%d", *slabZ))
+	if opts.SlabZ != 32 {
+		options = append(options, fmt.Sprintf("-slabZ=%d", opts.SlabZ))
 	}
 
-	if *roiFile != "" {
-		options = append(options, fmt.Sprintf("-roi=%s", *roiFile))
+	if opts.ROIFile != "" {
+		options = append(options, fmt.Sprintf("-roi=%s", opts.ROIFile))
 	}
 
-	if *compression != "lz4" {
-		options = append(options, fmt.Sprintf("-compress=%s", *compression))
+	if opts.Compression != "lz4" {
+		options = append(options, fmt.Sprintf("-compress=%s", opts.Compression))
 	}
 
-	if *outdir != "" {
-		options = append(options, fmt.Sprintf("-outdir=%s", *outdir))
+	if opts.OutDir != "" {
+		options = append(options, fmt.Sprintf("-outdir=%s", opts.OutDir))
 	}
-
-	if *url != "" {
-		options = append(options, fmt.Sprintf("-url=%s", *url))
+	if opts.Overwrite != exporter.OverwriteAlways {
+		options = append(options, fmt.Sprintf("-overwrite=%s", opts.Overwrite))
+	}
+	if !opts.Sidecars {
+		options = append(options, "-sidecars=false")
 	}
 
-	if *bodyoffset != 0 {
-		options = append(options, fmt.Sprintf("-bodyoffset=%d", *bodyoffset))
+	if opts.URL != "" {
+		options = append(options, fmt.Sprintf("-url=%s", opts.URL))
+	}
+	if opts.DVIDVerify {
+		options = append(options, "-dvidverify")
+	}
+	if opts.DVIDProtocol != defaults.DVIDProtocol {
+		options = append(options, fmt.Sprintf("-protocol=%s", opts.DVIDProtocol))
+	}
+	if opts.DVIDBlockSize != defaults.DVIDBlockSize {
+		options = append(options, fmt.Sprintf("-blocksize=%d", opts.DVIDBlockSize))
+	}
+	if opts.DVIDTimeout != defaults.DVIDTimeout {
+		options = append(options, fmt.Sprintf("-dvidtimeout=%s", opts.DVIDTimeout))
+	}
+	if opts.DVIDRetries != defaults.DVIDRetries {
+		options = append(options, fmt.Sprintf("-dvidretries=%d", opts.DVIDRetries))
+	}
+	if opts.DVIDThrottleWait != defaults.DVIDThrottleWait {
+		options = append(options, fmt.Sprintf("-dvidthrottle=%s", opts.DVIDThrottleWait))
+	}
+	if opts.DVIDDeadline != 0 {
+		options = append(options, fmt.Sprintf("-dviddeadline=%s", opts.DVIDDeadline))
 	}
 
-	var (
-		jobnum           int
-		zstart, curFiles int
-		zoffset          int // the starting z of current output buffer
-		first            bool
-	)
-	first = true
-	err = filepath.Walk(sp_dir, func(fullpath string, f os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Error traversing the superpixel image directory @ %s: %s\n", fullpath, err.Error())
-			os.Exit(1)
-		}
-		ext := filepath.Ext(fullpath)
-		if ext != ".png" {
-			fmt.Printf("Skipping transformation of non-PNG file: %s\n", fullpath)
-			return nil
-		}
+	if opts.BodyOffset != 0 {
+		options = append(options, fmt.Sprintf("-bodyoffset=%d", opts.BodyOffset))
+	}
 
-		// Parse the filename to get the Z slice.
-		rfrag := fileregex.FindString(fullpath) // gets everything from number through end of extension.
-		if len(rfrag) < 5 {
-			return fmt.Errorf("error parsing Z slice in filename %q", fullpath)
-		}
-		rfrag = rfrag[:len(rfrag)-4]
-		z, err := strconv.Atoi(rfrag)
-		if err != nil {
-			return fmt.Errorf("error parsing Z in filename %q: %s\n", fullpath, err.Error())
-		}
+	if opts.Supervoxels {
+		options = append(options, "-supervoxels")
+	}
 
-		// Skip files that aren't within our processing range.
-		if z < *minz || z > *maxz {
-			return nil
-		}
+	if opts.Unmapped != exporter.UnmappedZero {
+		options = append(options, fmt.Sprintf("-unmapped=%s", opts.Unmapped))
+	}
+	if opts.UnmappedBody != 0 {
+		options = append(options, fmt.Sprintf("-unmappedbody=%d", opts.UnmappedBody))
+	}
 
-		if first {
-			zstart = z
-			first = false
-		}
+	if opts.DecodeWorkers != defaults.DecodeWorkers {
+		options = append(options, fmt.Sprintf("-decoders=%d", opts.DecodeWorkers))
+	}
+	if opts.RelabelWorkers != defaults.RelabelWorkers {
+		options = append(options, fmt.Sprintf("-relabelers=%d", opts.RelabelWorkers))
+	}
+	if opts.WriteQueue != defaults.WriteQueue {
+		options = append(options, fmt.Sprintf("-writequeue=%d", opts.WriteQueue))
+	}
+	if opts.SlabWorkers != defaults.SlabWorkers {
+		options = append(options, fmt.Sprintf("-slabworkers=%d", opts.SlabWorkers))
+	}
+	if opts.MaxInflightBytes != defaults.MaxInflightBytes {
+		options = append(options, fmt.Sprintf("-maxinflight=%d", opts.MaxInflightBytes))
+	}
+	if opts.MemLimit != 0 {
+		options = append(options, fmt.Sprintf("-memlimit=%d", opts.MemLimit))
+	}
+	if opts.Resume {
+		options = append(options, "-resume")
+	}
+	if opts.StateDir != "" {
+		options = append(options, fmt.Sprintf("-statedir=%s", opts.StateDir))
+	}
 
-		// Good stopping place given block sizes?
-		if zhead(z) != zoffset {
-			zlast := zoffset + *slabZ - 1
-
-			if curFiles >= *filesPerJob {
-				cmd := fmt.Sprintf(`%s/raveler-exporter %s -minz=%d -maxz=%d %s %s %s`, *binpath,
-					strings.Join(options, " "), zstart, zlast, sp_to_seg, seg_to_body, sp_dir)
-
-				jobname := fmt.Sprintf("ravelerexport-%d", jobnum)
-				job := fmt.Sprintf(`qsub -pe batch 16 -N %s -j y -o %s.log -b y -cwd -V '%s >> %s.log'`, jobname, jobname, cmd, jobname)
-				job += "\n"
-
-				if _, err := file.WriteString(job); err != nil {
-					return err
-				}
-				zstart = z
-				curFiles = 0
-				jobnum++
-			}
-		}
+	// Compile the superpixel->body map first so jobs memory-map it instead of parsing
+	// the text maps.  Export jobs wait for the compile job to finish.
+	bodymap := opts.BodyMap
+	if bodymap == "" {
+		bodymap = *script + ".bodymap"
+	}
+	if bodymap, err = filepath.Abs(bodymap); err != nil {
+		return err
+	}
+	compileCmd := fmt.Sprintf(`%s/raveler-exporter -minz=%d -maxz=%d compile-map %s %s %s`, *binpath,
+		opts.MinZ, opts.MaxZ, sp_to_seg, seg_to_body, bodymap)
+	compileJob := fmt.Sprintf(`qsub -pe batch 16 -N %s -j y -o %s.log -b y -cwd -V '%s >> %s.log'`,
+		compileJobName, compileJobName, compileCmd, compileJobName)
+	if _, err := file.WriteString(compileJob + "\n"); err != nil {
+		return err
+	}
+	options = append(options, fmt.Sprintf("-bodymap=%s", bodymap))
 
-		// Count this file and see if we have enough to print a job in the script
-		zoffset = zhead(z)
-		curFiles++
-		return nil
-	})
+	zs, err := exporter.NewPNGDirSource(sp_dir).Zs(opts.MinZ, opts.MaxZ)
 	if err != nil {
-		fmt.Printf("Error traversing superpixel directory: %s\n", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("Error traversing superpixel directory: %s", err.Error())
 	}
-
-	if curFiles > 0 {
-		zlast := zoffset + *slabZ - 1
-
+	for jobnum, job := range opts.SplitJobs(zs, *filesPerJob) {
 		cmd := fmt.Sprintf(`%s/raveler-exporter %s -minz=%d -maxz=%d %s %s %s`, *binpath,
-			strings.Join(options, " "), zstart, zlast, sp_to_seg, seg_to_body, sp_dir)
+			strings.Join(options, " "), job.MinZ, job.MaxZ, sp_to_seg, seg_to_body, sp_dir)
 
 		jobname := fmt.Sprintf("ravelerexport-%d", jobnum)
-		job := fmt.Sprintf(`qsub -pe batch 16 -N %s -j y -o %s.log -b y -cwd -V '%s >> %s.log'`, jobname, jobname, cmd, jobname)
+		job := fmt.Sprintf(`qsub -pe batch 16 -N %s -hold_jid %s -j y -o %s.log -b y -cwd -V '%s >> %s.log'`,
+			jobname, compileJobName, jobname, cmd, jobname)
 		job += "\n"
 
 		if _, err := file.WriteString(job); err != nil {
@@ -0,0 +1,69 @@
+package slabs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// MetadataVersion is the version of the slab metadata format.
+const MetadataVersion = 1
+
+// SidecarExt is appended to the name of a slab file to get its metadata file.
+const SidecarExt = ".json"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC-32C used for slab data in metadata and manifests.
+func Checksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, crc32c))
+}
+
+// Session identifies the Raveler session a slab was exported from.
+type Session struct {
+	SuperpixelToSegment string `json:"superpixel_to_segment,omitempty"`
+	SegmentToBody       string `json:"segment_to_body,omitempty"`
+	BodyMap             string `json:"bodymap,omitempty"`
+	SuperpixelDir       string `json:"superpixel_dir,omitempty"`
+}
+
+// Metadata describes a slab file so it can be decoded without parsing its name.
+// It is written as a JSON sidecar named by appending SidecarExt to the slab file name.
+type Metadata struct {
+	Version  int    `json:"version"`
+	Size     [3]int `json:"size"`      // voxels along X, Y and Z
+	Origin   [3]int `json:"origin"`    // voxel coordinate of the first label
+	ValidMin [3]int `json:"valid_min"` // voxels outside ValidMin <= v < ValidMax are zero padding
+	ValidMax [3]int `json:"valid_max"`
+
+	DataType  string `json:"dtype"`      // "uint64"
+	ByteOrder string `json:"byte_order"` // "little-endian"
+	Order     string `json:"order"`      // "xyz": X varies fastest
+
+	Compression     string `json:"compression"`      // "lz4", "gzip" or "none"
+	Bytes           int    `json:"bytes"`            // uncompressed size
+	CompressedBytes int    `json:"compressed_bytes"` // size of the slab file
+	Checksum        string `json:"crc32c"`           // CRC-32C of the uncompressed labels
+	FileChecksum    string `json:"file_crc32c"`      // CRC-32C of the slab file
+
+	BodyOffset  int     `json:"body_offset"`
+	Supervoxels bool    `json:"supervoxels,omitempty"` // labels are supervoxel ids, not bodies
+	Session     Session `json:"session"`
+}
+
+// ReadMetadata reads the metadata sidecar of a slab file.
+func ReadMetadata(slabFile string) (*Metadata, error) {
+	data, err := os.ReadFile(slabFile + SidecarExt)
+	if err != nil {
+		return nil, err
+	}
+	var md Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, fmt.Errorf("Bad slab metadata for %q: %s", slabFile, err.Error())
+	}
+	if md.Version < 1 || md.Version > MetadataVersion {
+		return nil, fmt.Errorf("Slab metadata for %q has unsupported version %d", slabFile, md.Version)
+	}
+	return &md, nil
+}
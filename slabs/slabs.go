@@ -0,0 +1,209 @@
+// Package slabs reads the label slab files written by raveler-exporter: their names,
+// JSON metadata sidecars, and compressed labels.
+package slabs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	lz4 "github.com/janelia-flyem/go/golz4"
+)
+
+// nameRE matches the names of slab files, whose numbers are padded with spaces to
+// six places.
+var nameRE = regexp.MustCompile(`^bodies- *(\d+)x *(\d+)x *(\d+)\+ *(\d+)\+ *(\d+)\+ *(\d+)\.(lz4|gz|dat)$`)
+
+// Name returns the name of the slab file for a slab of the given size, origin and
+// compression.
+func Name(size, origin [3]int, compression string) (string, error) {
+	var ext string
+	switch compression {
+	case "none":
+		ext = "dat"
+	case "lz4":
+		ext = "lz4"
+	case "gzip":
+		ext = "gz"
+	default:
+		return "", fmt.Errorf("unknown compression type %q", compression)
+	}
+	return fmt.Sprintf("bodies-%6dx%6dx%6d+%6d+%6d+%6d.%s", size[0], size[1], size[2],
+		origin[0], origin[1], origin[2], ext), nil
+}
+
+// ParseName returns the metadata given by the name of a slab file.  The name doesn't
+// record padding, so the whole slab is taken as valid.
+func ParseName(filename string) (Metadata, error) {
+	m := nameRE.FindStringSubmatch(filepath.Base(filename))
+	if m == nil {
+		return Metadata{}, fmt.Errorf("%q isn't the name of a slab file", filename)
+	}
+	var nums [6]int
+	for i := range nums {
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return Metadata{}, fmt.Errorf("bad number in slab file name %q: %s", filename, err.Error())
+		}
+		nums[i] = n
+	}
+	md := Metadata{
+		Version:   MetadataVersion,
+		Size:      [3]int{nums[0], nums[1], nums[2]},
+		Origin:    [3]int{nums[3], nums[4], nums[5]},
+		DataType:  "uint64",
+		ByteOrder: "little-endian",
+		Order:     "xyz",
+	}
+	md.ValidMin = md.Origin
+	for i := range md.ValidMax {
+		md.ValidMax[i] = md.Origin[i] + md.Size[i]
+	}
+	switch m[7] {
+	case "lz4":
+		md.Compression = "lz4"
+	case "gz":
+		md.Compression = "gzip"
+	case "dat":
+		md.Compression = "none"
+	}
+	md.Bytes = md.Size[0] * md.Size[1] * md.Size[2] * 8
+	return md, nil
+}
+
+// File is a slab read back from a slab file.
+type File struct {
+	Filename   string
+	Metadata   Metadata // from the sidecar if there is one, else from the file name
+	HasSidecar bool
+	Labels     []uint64 // labels in X, then Y, then Z order
+}
+
+// Read reads and decompresses a slab file.  Its metadata sidecar is used if present,
+// and the slab's checksums are then checked against it.
+func Read(filename string) (*File, error) {
+	sf := &File{Filename: filename}
+	md, err := ReadMetadata(filename)
+	switch {
+	case err == nil:
+		sf.Metadata, sf.HasSidecar = *md, true
+	case os.IsNotExist(err):
+		if sf.Metadata, err = ParseName(filename); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	md = &sf.Metadata
+	if md.DataType != "uint64" || md.ByteOrder != "little-endian" || md.Order != "xyz" {
+		return nil, fmt.Errorf("can't read %s %s labels in %s order: %s", md.ByteOrder, md.DataType, md.Order, filename)
+	}
+	nbytes := md.Size[0] * md.Size[1] * md.Size[2] * 8
+
+	in, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if sf.HasSidecar {
+		if len(in) != md.CompressedBytes {
+			return nil, fmt.Errorf("slab file %q has %d bytes, expected %d", filename, len(in), md.CompressedBytes)
+		}
+		if sum := Checksum(in); sum != md.FileChecksum {
+			return nil, fmt.Errorf("slab file %q has checksum %s, expected %s", filename, sum, md.FileChecksum)
+		}
+	}
+	data, err := Uncompress(in, md.Compression, nbytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress slab file %q: %s", filename, err.Error())
+	}
+	if sf.HasSidecar {
+		if sum := Checksum(data); sum != md.Checksum {
+			return nil, fmt.Errorf("labels of slab file %q have checksum %s, expected %s", filename, sum, md.Checksum)
+		}
+	}
+
+	sf.Labels = make([]uint64, nbytes/8)
+	for i := range sf.Labels {
+		sf.Labels[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return sf, nil
+}
+
+// Uncompress returns the nbytes of data compressed in a slab file.  lz4 slabs are
+// raw blocks without a size, so the uncompressed size must be known.
+func Uncompress(in []byte, compression string, nbytes int) ([]byte, error) {
+	var out []byte
+	switch compression {
+	case "none":
+		out = in
+	case "lz4":
+		out = make([]byte, nbytes)
+		if err := lz4.Uncompress(in, out); err != nil {
+			return nil, err
+		}
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+		if out, err = ioutil.ReadAll(gr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression type %q", compression)
+	}
+	if len(out) != nbytes {
+		return nil, fmt.Errorf("got %d bytes of labels, expected %d", len(out), nbytes)
+	}
+	return out, nil
+}
+
+// Label returns the label at a voxel coordinate within the slab.
+func (sf *File) Label(x, y, z int) uint64 {
+	md := &sf.Metadata
+	x, y, z = x-md.Origin[0], y-md.Origin[1], z-md.Origin[2]
+	return sf.Labels[(z*md.Size[1]+y)*md.Size[0]+x]
+}
+
+// BodyCount is the number of voxels of a body within a slab.
+type BodyCount struct {
+	Body   uint64
+	Voxels int
+}
+
+// BodyCounts returns the voxel counts of the distinct labels in the slab, including
+// label 0, sorted by decreasing count and then label.
+func (sf *File) BodyCounts() []BodyCount {
+	counts := make(map[uint64]int)
+	var last uint64
+	var run int
+	for i, label := range sf.Labels {
+		if i != 0 && label != last {
+			counts[last] += run
+			run = 0
+		}
+		last = label
+		run++
+	}
+	if run != 0 {
+		counts[last] += run
+	}
+	bodies := make([]BodyCount, 0, len(counts))
+	for body, n := range counts {
+		bodies = append(bodies, BodyCount{body, n})
+	}
+	sort.Slice(bodies, func(i, j int) bool {
+		if bodies[i].Voxels != bodies[j].Voxels {
+			return bodies[i].Voxels > bodies[j].Voxels
+		}
+		return bodies[i].Body < bodies[j].Body
+	})
+	return bodies
+}